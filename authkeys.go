@@ -8,245 +8,3852 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math/big"
+	"math/rand"
 	"net"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
+	"gopkg.in/asn1-ber.v1"
 	"gopkg.in/ldap.v2"
 )
 
+// Exit codes, beyond the 1 that log.Fatal uses for everything else.
+const (
+	exitConfig             = 2
+	exitInsufficientAccess = 3
+	exitUserNotFound       = 4
+	exitMultipleUsers      = 5
+	exitConnect            = 6
+	exitBind               = 7
+	exitNoKeys             = 8
+	exitKeysDiffer         = 9
+)
+
+// Errors that callers can tell apart with errors.Is. Failures further down
+// are wrapped with %w so the original detail stays in the message.
+var (
+	errUserNotFound  = errors.New("No entries returned from LDAP")
+	errMultipleUsers = errors.New("Too many entries returned from LDAP")
+	errNoKeys        = errors.New("No keys")
+	errConnect       = errors.New("Unable to connect")
+	errBind          = errors.New("Unable to bind")
+)
+
 type AuthkeysConfig struct {
-	BaseDN        string
-	GroupObject   string
-	DialTimeout   int
-	KeyAttribute  string
-	LDAPServer    string
-	LDAPPort      int
-	RootCAFile    string
-	UserAttribute string
-	UserPostfix   string
-	BindDN        string
-	BindPW        string
+	BaseDN         string
+	GroupObject    string
+	DialTimeout    int
+	KeyAttribute   string
+	LDAPServer     string
+	LDAPPort       int
+	RootCAFile     string
+	UserAttribute  string
+	UserPostfix    string
+	BindDN         string
+	BindPW         string
+	CanaryUsers    []string
+	UseTokenGroups bool
+
+	ServiceAccountPrefix       string
+	ServiceAccountBaseDN       string
+	ServiceAccountKeyAttribute string
+
+	ConfigDir string
+
+	DenyUsers []string
+
+	OpDeadlineSeconds int
+
+	AliasAttribute string
+
+	HomeTemplate         string
+	HomeTemplateOverride bool
+
+	KeyAttributeFallbacks []string
+
+	IgnoreResultCodes []int
+
+	UseLDAPS bool
+
+	KeyValidityAttribute string
+
+	IDSelection  string
+	PreferredIDs []string
+
+	SelfTestUsername         string
+	SelfTestExpectedKeyCount int
+
+	LDAPServers []LDAPServerConfig
+
+	KeyOptionsAttribute string
+
+	ShutdownTimeoutSeconds int
+
+	AttributeMap map[string]string
+
+	UserAttributeCandidates []string
+
+	MinUID int
+	MaxUID int
+
+	ClientCertFile string
+	ClientKeyFile  string
+
+	UserFilterExtra  string
+	GroupFilterExtra string
+
+	AllowedHostsAttribute string
+	HostName              string
+
+	Profiles map[string]json.RawMessage
+
+	ReferralServer *LDAPServerConfig
+
+	MissingUidPolicy string
+
+	KeyTypeOrder []string
+
+	GroupOutputFormat string
+
+	PrimaryGroupAttribute string
+
+	MaxKeyLineBytes int
+
+	ServerSideSort bool
+
+	RequiredGroup      string
+	RequiredGroupStyle string
+
+	FallbackRootCAFile string
+
+	PreLookupCommand        []string
+	PreLookupTimeoutSeconds int
+
+	SessionTicketsDisabled bool
+
+	SplitKeyValuesOnNewline bool
+
+	ConnectBudgetSeconds int
+
+	KeyExpiryTimeOption bool
+
+	MultipleEntryPolicy string
+
+	BindPWKeyring string
+
+	MaxRecentKeys         int
+	KeyTimestampAttribute string
+
+	ExpectedObjectClass string
+
+	StartTLSTimeoutSeconds int
+
+	AnnotateProvenance bool
+
+	AllowedECDSACurves []string
+
+	RequireCompletePosixAccount bool
+
+	ClockSkewSeconds int
+
+	AccessScheduleAttribute string
+
+	StartTLSFallbackToLDAPS bool
+
+	EmailAttribute       string
+	DisplayNameAttribute string
+
+	RequireKeyPresent bool
+
+	AllowedSignersPrincipal  string
+	AllowedSignersNamespaces []string
+
+	PreferNearestServer       bool
+	NearestServerProbeMillis  int
+	NearestServerCacheFile    string
+	NearestServerCacheSeconds int
+
+	MatchingRules map[string]string
+
+	OutputPrefix string
+	OutputSuffix string
+
+	EmptyResultRetries          int
+	EmptyResultRetryMillis      int
+	EmptyResultRetryOtherServer bool
+
+	PrincipalAttribute string
+
+	FromCIDRAttribute string
+
+	PEMKeyPolicy string
+
+	StartupJitterMs          int
+	StartupJitterInteractive bool
+
+	RestrictKeys    bool
+	RestrictOptions []string
+
+	StripDomainPrefix     bool
+	DomainPrefixSeparator string
+
+	CertExpiryWarnDays int
+	CertExpiryFailDays int
+}
+
+// LDAPServerConfig is one entry in the LDAPServers failover list, or the
+// ReferralServer. Like SRV records, servers with a lower Priority are tried
+// first and Weight spreads load between servers of equal priority. The TLS
+// settings override the global ones for this server when set.
+type LDAPServerConfig struct {
+	Host     string
+	Port     int
+	Priority int
+	Weight   int
+
+	ServerName     string
+	RootCAFile     string
+	ClientCertFile string
+	ClientKeyFile  string
+}
+
+type User struct {
+	Uid           string   `json:"id"`
+	UidNumber     string   `json:"uid"`
+	GidNumber     string   `json:"gid"`
+	MemberOf      []string `json:"groups"`
+	HomeDirectory string   `json:"home"`
+	Shell         string   `json:"shell"`
+	Email         string   `json:"email,omitempty"`
+	Name          string   `json:"name,omitempty"`
+	DN            string   `json:"dn,omitempty"`
+}
+
+// loadConfig reads configfile, which may be a colon-separated list of files
+// merged left to right, skipping any that don't exist. The drop-in files
+// from ConfigDir are then merged over it. With strict set, unknown keys are
+// errors; otherwise they are logged and ignored.
+func loadConfig(configfile string, strict bool) (AuthkeysConfig, error) {
+	config := AuthkeysConfig{}
+	files := filepath.SplitList(configfile)
+	found := false
+	for _, file := range files {
+		if _, err := os.Stat(file); err != nil {
+			if len(files) > 1 {
+				log.Printf("Warning: skipping config file %s: %s", file, err)
+			}
+			continue
+		}
+		if err := mergeConfig(&config, file, strict); err != nil {
+			return config, err
+		}
+		found = true
+	}
+	if err := mergeConfigDir(&config, strict); err != nil {
+		return config, err
+	}
+	if name := os.Getenv("AUTHKEYS_PROFILE"); name != "" {
+		profile, ok := config.Profiles[name]
+		if !ok {
+			return config, fmt.Errorf("AUTHKEYS_PROFILE: no profile named %q", name)
+		}
+		if err := decodeConfig(&config, profile, "profile "+name, strict); err != nil {
+			return config, err
+		}
+	}
+	if !found && config.LDAPServer == "" && len(config.LDAPServers) == 0 {
+		return config, fmt.Errorf("config file not found at %s, set AUTHKEYS_CONFIG to its path", configfile)
+	}
+	if config.BindPWKeyring != "" {
+		password, err := readKeyring(config.BindPWKeyring)
+		if err != nil {
+			return config, fmt.Errorf("BindPWKeyring: %s", err)
+		}
+		config.BindPW = password
+	}
+	return config, validateConfig(config)
+}
+
+// validateConfig catches settings that would otherwise only fail, or
+// silently do nothing, at lookup time.
+func validateConfig(config AuthkeysConfig) error {
+	if config.LDAPServer == "" && len(config.LDAPServers) == 0 {
+		return fmt.Errorf("No LDAPServer or LDAPServers configured")
+	}
+	for field := range config.AttributeMap {
+		if _, ok := defaultAttributeMap[field]; !ok {
+			return fmt.Errorf("AttributeMap: unknown field %q", field)
+		}
+	}
+	switch config.IDSelection {
+	case "", "first", "lowest", "highest":
+	default:
+		return fmt.Errorf("IDSelection %q must be \"first\", \"lowest\" or \"highest\"", config.IDSelection)
+	}
+	for name, fragment := range map[string]string{
+		"UserFilterExtra":  config.UserFilterExtra,
+		"GroupFilterExtra": config.GroupFilterExtra,
+	} {
+		if fragment == "" {
+			continue
+		}
+		if _, err := ldap.CompileFilter(fragment); err != nil {
+			return fmt.Errorf("%s %q is not a valid LDAP filter: %s", name, fragment, err)
+		}
+	}
+	for attribute, rule := range config.MatchingRules {
+		if !validMatchingRule(rule) {
+			return fmt.Errorf("MatchingRules: %q for %s is not a matching rule name or OID", rule, attribute)
+		}
+		if _, err := ldap.CompileFilter(matchAssertion(config, attribute, "x")); err != nil {
+			return fmt.Errorf("MatchingRules: %q for %s: %s", rule, attribute, err)
+		}
+	}
+	if err := validateFilters(config); err != nil {
+		return err
+	}
+	for name, marker := range map[string]string{"OutputPrefix": config.OutputPrefix, "OutputSuffix": config.OutputSuffix} {
+		if marker != "" && (!strings.HasPrefix(marker, "#") || strings.ContainsAny(marker, "\r\n")) {
+			return fmt.Errorf("%s %q must be a single comment line starting with #", name, marker)
+		}
+	}
+	switch config.MissingUidPolicy {
+	case "", "skip", "dn":
+	default:
+		return fmt.Errorf("MissingUidPolicy %q must be \"skip\" or \"dn\"", config.MissingUidPolicy)
+	}
+	if policy := config.MultipleEntryPolicy; policy != "" && policy != "error" && policy != "first" && policy != "union" &&
+		!strings.HasPrefix(policy, "prefer-base ") {
+		return fmt.Errorf("MultipleEntryPolicy %q must be \"error\", \"first\", \"union\" or \"prefer-base <dn>\"", policy)
+	}
+	switch config.RequiredGroupStyle {
+	case "", "memberOf", "memberUid":
+	case "compare":
+		if !strings.Contains(config.RequiredGroup, "=") && config.GroupObject == "" {
+			return fmt.Errorf("RequiredGroupStyle \"compare\" needs RequiredGroup to be a DN, or GroupObject to build one")
+		}
+	default:
+		return fmt.Errorf("RequiredGroupStyle %q must be \"memberOf\", \"memberUid\" or \"compare\"", config.RequiredGroupStyle)
+	}
+	if len(config.RestrictOptions) > 0 && !config.RestrictKeys {
+		return fmt.Errorf("RestrictOptions needs RestrictKeys")
+	}
+	for _, option := range config.RestrictOptions {
+		if !restrictReenable(option) {
+			return fmt.Errorf("RestrictOptions: %q is not one of %s", option, strings.Join(restrictReenables, ", "))
+		}
+	}
+	switch config.PEMKeyPolicy {
+	case "", "convert", "skip":
+	default:
+		return fmt.Errorf("PEMKeyPolicy %q must be \"convert\" or \"skip\"", config.PEMKeyPolicy)
+	}
+	switch config.GroupOutputFormat {
+	case "", "cn", "dn", "gidNumber":
+	default:
+		return fmt.Errorf("GroupOutputFormat %q must be \"cn\", \"dn\" or \"gidNumber\"", config.GroupOutputFormat)
+	}
+	if config.EmptyResultRetryOtherServer && len(config.LDAPServers) < 2 {
+		return fmt.Errorf("EmptyResultRetryOtherServer needs at least two LDAPServers")
+	}
+	switch config.AllowedSignersPrincipal {
+	case "", "uid":
+	case "email":
+		if config.EmailAttribute == "" {
+			return fmt.Errorf("AllowedSignersPrincipal \"email\" needs EmailAttribute")
+		}
+	default:
+		return fmt.Errorf("AllowedSignersPrincipal %q must be \"uid\" or \"email\"", config.AllowedSignersPrincipal)
+	}
+	return nil
+}
+
+// validateFilters builds the user and group search filters with placeholder
+// names and checks that they parse, so that a setting which breaks them
+// fails at startup rather than at every login. The message names the
+// settings the filter was built from, and those of them holding characters
+// that mean something in a filter.
+func validateFilters(config AuthkeysConfig) error {
+	candidates := config.UserAttributeCandidates
+	if len(candidates) == 0 && config.UserAttribute != "" {
+		candidates = []string{config.UserAttribute}
+	}
+	for _, attribute := range candidates {
+		filter := userFilter(config, attribute, "authkeys-check")
+		if _, err := ldap.CompileFilter(filter); err != nil {
+			return fmt.Errorf("User search filter %q is not a valid LDAP filter: %s%s", filter, err, filterSuspects([][2]string{
+				{"UserAttribute or UserAttributeCandidates", attribute},
+				{"AliasAttribute", config.AliasAttribute},
+			}))
+		}
+	}
+	if config.GroupObject == "" {
+		return nil
+	}
+	filter := groupFilter(config, "authkeys-check")
+	if _, err := ldap.CompileFilter(filter); err != nil {
+		suspects := [][2]string{
+			{"AttributeMap MemberOf", attributeName(config, "MemberOf")},
+			{"GroupObject", config.GroupObject},
+			{"BaseDN", config.BaseDN},
+		}
+		if config.RequireKeyPresent {
+			for _, attribute := range append([]string{config.KeyAttribute}, config.KeyAttributeFallbacks...) {
+				suspects = append(suspects, [2]string{"KeyAttribute or KeyAttributeFallbacks", attribute})
+			}
+		}
+		return fmt.Errorf("Group search filter %q is not a valid LDAP filter: %s%s", filter, err, filterSuspects(suspects))
+	}
+	return nil
+}
+
+// filterSuspects describes which of the named settings hold parentheses or
+// backslashes, which have to be escaped in a filter.
+func filterSuspects(settings [][2]string) string {
+	var suspects []string
+	for _, setting := range settings {
+		if strings.ContainsAny(setting[1], "()\\") {
+			suspects = append(suspects, fmt.Sprintf("%s %q", setting[0], setting[1]))
+		}
+	}
+	if len(suspects) == 0 {
+		return ""
+	}
+	return " (check " + strings.Join(suspects, ", ") + ")"
+}
+
+// mergeConfig decodes fname over config. Keys present in the file replace
+// the current value wholesale, so lists are replaced rather than appended
+// to; keys absent from the file are left alone.
+func mergeConfig(config *AuthkeysConfig, fname string, strict bool) error {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return err
+	}
+	return decodeConfig(config, data, fname, strict)
+}
+
+// decodeConfig decodes data over config, reporting errors against source.
+func decodeConfig(config *AuthkeysConfig, data []byte, source string, strict bool) error {
+	// json.Unmarshal silently drops keys it doesn't know about, which turns
+	// a typo into a setting that does nothing.
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(config)
+	if err != nil && !strict && strings.HasPrefix(err.Error(), "json: unknown field ") {
+		log.Printf("Warning: %s: %s", source, err)
+		err = json.Unmarshal(data, config)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %s", source, err)
+	}
+	return nil
+}
+
+// mergeConfigDir merges every *.json file in ConfigDir (by default
+// /etc/authkeys.d) over config in lexical order.
+func mergeConfigDir(config *AuthkeysConfig, strict bool) error {
+	dir := config.ConfigDir
+	if dir == "" {
+		dir = "/etc/authkeys.d"
+	}
+	// Glob returns matches sorted, which gives us lexical ordering.
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := mergeConfig(config, file, strict); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// conn is an LDAP connection along with the network connection underneath
+// it, so that deadlines can be applied to individual LDAP operations.
+type conn struct {
+	*ldap.Conn
+	host        string
+	netConn     net.Conn
+	compares    <-chan *ber.Packet
+	opDeadline  time.Duration
+	ignoreCodes []int
+
+	// connectReferral, if set, connects to the ReferralServer that searches
+	// answered with a referral are retried against. referral is that
+	// connection once it has been made.
+	connectReferral func() (*conn, error)
+	referral        *conn
+
+	// budgetDeadline is when ConnectBudgetSeconds runs out, if set.
+	budgetDeadline time.Time
+}
+
+// traceEnabled is set by the -trace flag.
+var traceEnabled bool
+
+// explainEnabled is set by the -explain flag.
+var explainEnabled bool
+
+// explainf prints one line of the -explain diagnosis of a lookup.
+func explainf(format string, args ...interface{}) {
+	if explainEnabled {
+		fmt.Printf("  "+format+"\n", args...)
+	}
+}
+
+// traceStep logs how long a step of talking to the directory took when
+// -trace is enabled.
+func traceStep(step string, start time.Time, detail string, err error) {
+	if !traceEnabled {
+		return
+	}
+	status := "ok"
+	if err != nil {
+		status = "fail"
+	}
+	log.Printf("trace: step=%s status=%s duration=%s %s", step, status, time.Since(start), detail)
+}
+
+// do runs op with the configured per-operation deadline set on the network
+// connection, tracing it as step. The deadline is cleared afterwards so an
+// idle connection isn't torn down between operations.
+func (l *conn) do(step, detail string, op func() error) error {
+	start := time.Now()
+	if l.opDeadline > 0 {
+		l.netConn.SetDeadline(time.Now().Add(l.opDeadline))
+		defer l.netConn.SetDeadline(time.Time{})
+	}
+	err := op()
+	traceStep(step, start, detail, err)
+	return err
+}
+
+func (l *conn) Bind(username, password string) error {
+	return l.do("bind", fmt.Sprintf("dn=%q", username), func() error {
+		return l.Conn.Bind(username, password)
+	})
+}
+
+// Compare asks the server whether the entry at dn has value for attribute.
+// ldap.v2's Compare sends the value as a constructed OCTET STRING, which
+// strict servers reject, so the request is encoded here and its response
+// taken off the connection by compareConn before ldap.v2 sees it.
+func (l *conn) Compare(dn, attribute, value string) (bool, error) {
+	var matched bool
+	err := l.do("compare", fmt.Sprintf("dn=%q attribute=%s", dn, attribute), func() error {
+		request := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationCompareRequest, nil, "Compare Request")
+		request.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, "DN"))
+		ava := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "AttributeValueAssertion")
+		ava.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, attribute, "AttributeDesc"))
+		ava.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "AssertionValue"))
+		request.AppendChild(ava)
+		if _, err := l.netConn.Write(ldapMessage(compareMessageID, request).Bytes()); err != nil {
+			return ldap.NewError(ldap.ErrorNetwork, err)
+		}
+		response, ok := <-l.compares
+		if !ok {
+			return ldap.NewError(ldap.ErrorNetwork, errors.New("connection closed before the compare was answered"))
+		}
+		switch code, message := ldapResult(response); code {
+		case ldap.LDAPResultCompareTrue:
+			matched = true
+		case ldap.LDAPResultCompareFalse:
+		default:
+			return ldap.NewError(code, errors.New(message))
+		}
+		return nil
+	})
+	return matched, err
+}
+
+func (l *conn) Search(searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	var sr *ldap.SearchResult
+	detail := fmt.Sprintf("base=%q filter=%q", searchRequest.BaseDN, searchRequest.Filter)
+	err := l.do("search", detail, func() error {
+		var err error
+		sr, err = l.Conn.Search(searchRequest)
+		return err
+	})
+	// Some directories return a non-success result code such as size limit
+	// exceeded alongside perfectly good entries.
+	if ldapErr, ok := err.(*ldap.Error); ok && sr != nil {
+		for _, code := range l.ignoreCodes {
+			if int(ldapErr.ResultCode) == code {
+				log.Printf("Ignoring LDAP result for search of %s: %s", searchRequest.BaseDN, err)
+				return sr, nil
+			}
+		}
+	}
+	if l.connectReferral != nil && isReferral(sr, err) {
+		if l.referral == nil {
+			referral, connErr := l.connectReferral()
+			if connErr != nil {
+				return sr, fmt.Errorf("Unable to follow referral for search of %s: %s", searchRequest.BaseDN, connErr)
+			}
+			l.referral = referral
+		}
+		log.Printf("Following referral for search of %s", searchRequest.BaseDN)
+		return l.referral.Search(searchRequest)
+	}
+	return sr, err
+}
+
+// isReferral reports whether a search was answered with a referral rather
+// than with entries.
+func isReferral(sr *ldap.SearchResult, err error) bool {
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultReferral) {
+		return true
+	}
+	return err == nil && sr != nil && len(sr.Entries) == 0 && len(sr.Referrals) > 0
+}
+
+func (l *conn) Close() {
+	if l.referral != nil {
+		l.referral.Close()
+	}
+	// The connection is closed whether or not the unbind could be sent, so
+	// a failure is only worth tracing.
+	l.unbind()
+	l.Conn.Close()
+}
+
+// unbindMessageID is the largest LDAP message ID, which ldap.v2, counting up
+// from 1 on each connection, never reaches.
+const unbindMessageID = 1<<31 - 1
+
+// unbind tells the server the session is over so that it doesn't log the
+// close as an abnormal disconnect. ldap.v2 has no Unbind, and the server
+// sends no reply.
+func (l *conn) unbind() error {
+	return l.do("unbind", "", func() error {
+		request := ber.Encode(ber.ClassApplication, ber.TypePrimitive, ldap.ApplicationUnbindRequest, nil, "Unbind Request")
+		_, err := l.netConn.Write(ldapMessage(unbindMessageID, request).Bytes())
+		return err
+	})
+}
+
+// compareMessageID is the message ID of the compares conn sends itself, just
+// below unbindMessageID.
+const compareMessageID = unbindMessageID - 1
+
+// compareConn is the connection ldap.v2 reads from. It passes every message
+// through except the responses to conn's own compares, which ldap.v2 would
+// discard as unexpected, and which go to compares instead.
+type compareConn struct {
+	net.Conn
+	compares chan *ber.Packet
+	pending  []byte
+	done     sync.Once
+}
+
+func newCompareConn(c net.Conn) *compareConn {
+	return &compareConn{Conn: c, compares: make(chan *ber.Packet, 1)}
+}
+
+func (c *compareConn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		packet, err := ber.ReadPacket(c.Conn)
+		if err != nil {
+			// ldap.v2 gives up on the connection too, so no answer is coming.
+			c.done.Do(func() { close(c.compares) })
+			return 0, err
+		}
+		if len(packet.Children) > 0 {
+			if id, _ := packet.Children[0].Value.(int64); id == compareMessageID {
+				select {
+				case c.compares <- packet:
+				default:
+				}
+				continue
+			}
+		}
+		c.pending = packet.Bytes()
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// ldapMessage wraps op in an LDAPMessage envelope with the given message ID.
+func ldapMessage(id int64, op *ber.Packet) *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Request")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "MessageID"))
+	packet.AppendChild(op)
+	return packet
+}
+
+// startTLS upgrades server with the StartTLS extended operation. It is done
+// here rather than with ldap.v2's StartTLS, which keeps the TLS connection to
+// itself, so that unbind can write to it and so that handshake errors keep
+// their type. A refusal is returned as an *ldap.Error with the server's
+// result code. timeout, if set, bounds the whole upgrade.
+func startTLS(server net.Conn, tlsConfig *tls.Config, timeout time.Duration) (*tls.Conn, error) {
+	if timeout > 0 {
+		server.SetDeadline(time.Now().Add(timeout))
+		defer server.SetDeadline(time.Time{})
+	}
+	request := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationExtendedRequest, nil, "Start TLS")
+	request.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, "1.3.6.1.4.1.1466.20037", "TLS Extended Command"))
+	if _, err := server.Write(ldapMessage(1, request).Bytes()); err != nil {
+		return nil, err
+	}
+	response, err := ber.ReadPacket(server)
+	if err != nil {
+		return nil, err
+	}
+	if code, message := ldapResult(response); code != ldap.LDAPResultSuccess {
+		return nil, ldap.NewError(code, fmt.Errorf("server refused StartTLS: %q", message))
+	}
+	tlsConn := tls.Client(server, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	return tlsConn, nil
+}
+
+// startTLSUnsupported reports whether err is a server saying it doesn't
+// offer StartTLS, as opposed to StartTLS failing.
+func startTLSUnsupported(err error) bool {
+	var ldapErr *ldap.Error
+	return errors.As(err, &ldapErr) &&
+		(ldapErr.ResultCode == ldap.LDAPResultProtocolError || ldapErr.ResultCode == ldap.LDAPResultUnavailable)
+}
+
+// ldapResult returns the result code and diagnostic message of an LDAP
+// response.
+func ldapResult(packet *ber.Packet) (uint8, string) {
+	if len(packet.Children) >= 2 && len(packet.Children[1].Children) >= 3 {
+		code, ok := packet.Children[1].Children[0].Value.(int64)
+		message, _ := packet.Children[1].Children[2].Value.(string)
+		if ok {
+			return uint8(code), message
+		}
+	}
+	return ldap.ErrorUnexpectedResponse, "malformed response"
+}
+
+// newTLSConfig builds the TLS configuration used to talk to server, using
+// the server's own TLS settings where it has them and the global ones
+// otherwise.
+func newTLSConfig(config AuthkeysConfig, server LDAPServerConfig) (*tls.Config, error) {
+	serverName := server.Host
+	if server.ServerName != "" {
+		serverName = server.ServerName
+	}
+	rootCAPath := config.RootCAFile
+	if server.RootCAFile != "" {
+		rootCAPath = server.RootCAFile
+	}
+	certPath, keyPath := config.ClientCertFile, config.ClientKeyFile
+	if server.ClientCertFile != "" {
+		certPath, keyPath = server.ClientCertFile, server.ClientKeyFile
+	}
+
+	// Need a place to store TLS configuration
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: false,
+		ServerName:         serverName,
+		// Already Go's default, but spelled out for auditors.
+		Renegotiation:          tls.RenegotiateNever,
+		SessionTicketsDisabled: config.SessionTicketsDisabled,
+	}
+
+	// Configure additional trust roots if necessary
+	if rootCAPath != "" {
+		rootCerts, err := readCertPool(rootCAPath, "RootCAFile")
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = rootCerts
+	}
+
+	// During a CA rollover, accept certificates from the old CA too, but
+	// only once they have failed to verify against the current one.
+	if config.FallbackRootCAFile != "" {
+		fallbackCerts, err := readCertPool(config.FallbackRootCAFile, "FallbackRootCAFile")
+		if err != nil {
+			return nil, err
+		}
+		rootCerts := tlsConfig.RootCAs
+		// Verification is done by VerifyConnection instead.
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			err := verifyPeer(cs, serverName, rootCerts)
+			if err == nil {
+				return nil
+			}
+			if verifyPeer(cs, serverName, fallbackCerts) != nil {
+				return err
+			}
+			log.Printf("Certificate from %s only verified against FallbackRootCAFile", serverName)
+			return nil
+		}
+	}
+
+	// The expiry check runs once the certificate has verified, whichever
+	// way that was done.
+	if config.CertExpiryWarnDays > 0 || config.CertExpiryFailDays > 0 {
+		verify := tlsConfig.VerifyConnection
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			if verify != nil {
+				if err := verify(cs); err != nil {
+					return err
+				}
+			}
+			return checkCertExpiry(config, serverName, cs)
+		}
+	}
+
+	// Present a client certificate if the directory wants one
+	if certPath != "" {
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// readCertPool reads a PEM bundle of CA certificates from path; name is the
+// config key it came from, for error messages.
+func readCertPool(path, name string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read %s: %s", name, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("Unable to append to CertPool from %s", name)
+	}
+	return pool, nil
+}
+
+// checkCertExpiry refuses a server whose certificate expires within
+// CertExpiryFailDays, so that connect moves on to the next of the
+// LDAPServers, and logs a warning for one that expires within
+// CertExpiryWarnDays, so that renewals happen before logins start failing.
+func checkCertExpiry(config AuthkeysConfig, serverName string, cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("server presented no certificate")
+	}
+	notAfter := cs.PeerCertificates[0].NotAfter
+	remaining := time.Until(notAfter)
+	if config.CertExpiryFailDays > 0 && remaining < time.Duration(config.CertExpiryFailDays)*24*time.Hour {
+		return fmt.Errorf("Certificate from %s expires at %s, within CertExpiryFailDays of %d",
+			serverName, notAfter.Format(time.RFC3339), config.CertExpiryFailDays)
+	}
+	if config.CertExpiryWarnDays > 0 && remaining < time.Duration(config.CertExpiryWarnDays)*24*time.Hour {
+		log.Printf("Warning: certificate from %s expires at %s, within CertExpiryWarnDays of %d",
+			serverName, notAfter.Format(time.RFC3339), config.CertExpiryWarnDays)
+	}
+	return nil
+}
+
+// verifyPeer verifies the server's certificate chain from cs against roots,
+// or the system roots if roots is nil, and checks it is valid for
+// serverName.
+func verifyPeer(cs tls.ConnectionState, serverName string, roots *x509.CertPool) error {
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("server presented no certificate")
+	}
+	opts := x509.VerifyOptions{
+		DNSName:       serverName,
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// orderedServers returns the servers to try, in order. Without an
+// LDAPServers list that is just LDAPServer. Otherwise servers are sorted by
+// Priority and shuffled by Weight within each priority.
+func orderedServers(config AuthkeysConfig) []LDAPServerConfig {
+	if len(config.LDAPServers) == 0 {
+		return []LDAPServerConfig{{Host: config.LDAPServer, Port: config.LDAPPort}}
+	}
+	servers := make([]LDAPServerConfig, len(config.LDAPServers))
+	copy(servers, config.LDAPServers)
+	for i := range servers {
+		if servers[i].Port == 0 {
+			servers[i].Port = config.LDAPPort
+		}
+	}
+	sort.SliceStable(servers, func(i, j int) bool {
+		return servers[i].Priority < servers[j].Priority
+	})
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for start := 0; start < len(servers); {
+		end := start
+		for end < len(servers) && servers[end].Priority == servers[start].Priority {
+			end++
+		}
+		weightedShuffle(rng, servers[start:end])
+		start = end
+	}
+	return servers
+}
+
+// preferNearest moves the server with the quickest TCP connect to the front
+// of servers, leaving the rest in order. Every server is dialled at once and
+// given NearestServerProbeMillis (default 250) to answer. With a
+// NearestServerCacheFile, the choice is kept for NearestServerCacheSeconds
+// (default 300) so that most lookups don't probe at all.
+func preferNearest(config AuthkeysConfig, servers []LDAPServerConfig) []LDAPServerConfig {
+	cacheTTL := 300 * time.Second
+	if config.NearestServerCacheSeconds != 0 {
+		cacheTTL = time.Duration(config.NearestServerCacheSeconds) * time.Second
+	}
+	address := func(server LDAPServerConfig) string {
+		return net.JoinHostPort(server.Host, strconv.Itoa(server.Port))
+	}
+
+	nearest := ""
+	if config.NearestServerCacheFile != "" {
+		if info, err := os.Stat(config.NearestServerCacheFile); err == nil && time.Since(info.ModTime()) < cacheTTL {
+			if data, err := ioutil.ReadFile(config.NearestServerCacheFile); err == nil {
+				nearest = strings.TrimSpace(string(data))
+			}
+		}
+	}
+	if nearest == "" {
+		timeout := 250 * time.Millisecond
+		if config.NearestServerProbeMillis != 0 {
+			timeout = time.Duration(config.NearestServerProbeMillis) * time.Millisecond
+		}
+		type probe struct {
+			address string
+			rtt     time.Duration
+			err     error
+		}
+		results := make(chan probe, len(servers))
+		for _, server := range servers {
+			go func(address string) {
+				start := time.Now()
+				c, err := net.DialTimeout("tcp", address, timeout)
+				rtt := time.Since(start)
+				if err == nil {
+					c.Close()
+				}
+				results <- probe{address, rtt, err}
+			}(address(server))
+		}
+		var best time.Duration
+		for range servers {
+			result := <-results
+			traceStep("probe", time.Now().Add(-result.rtt), "address="+result.address, result.err)
+			if result.err == nil && (nearest == "" || result.rtt < best) {
+				nearest, best = result.address, result.rtt
+			}
+		}
+		if nearest == "" {
+			return servers
+		}
+		if config.NearestServerCacheFile != "" {
+			if err := writeLinesFile(config.NearestServerCacheFile, []string{nearest}); err != nil {
+				log.Printf("Warning: unable to cache the nearest server: %s", err)
+			}
+		}
+	}
+
+	for i, server := range servers {
+		if address(server) == nearest {
+			preferred := append([]LDAPServerConfig{server}, servers[:i]...)
+			return append(preferred, servers[i+1:]...)
+		}
+	}
+	return servers
+}
+
+// weightedShuffle orders servers randomly, with each position picked with
+// probability proportional to Weight. Servers with no weight are only picked
+// once the weighted ones are used up.
+func weightedShuffle(rng *rand.Rand, servers []LDAPServerConfig) {
+	for i := range servers {
+		total := 0
+		for _, server := range servers[i:] {
+			total += server.Weight
+		}
+		pick := i + rng.Intn(len(servers)-i)
+		if total > 0 {
+			r := rng.Intn(total)
+			for j := i; j < len(servers); j++ {
+				r -= servers[j].Weight
+				if r < 0 {
+					pick = j
+					break
+				}
+			}
+		}
+		servers[i], servers[pick] = servers[pick], servers[i]
+	}
+}
+
+// connect connects to the first reachable server from orderedServers.
+func connect(config AuthkeysConfig) (*conn, error) {
+	var err error
+	servers := orderedServers(config)
+	if config.PreferNearestServer && len(servers) > 1 {
+		servers = preferNearest(config, servers)
+	}
+	deadline := time.Now().Add(time.Duration(config.ConnectBudgetSeconds) * time.Second)
+	for i, server := range servers {
+		timeout := dialTimeout(config)
+		if config.ConnectBudgetSeconds > 0 {
+			// Share what is left of the budget between the servers not yet
+			// tried, so a run of dead servers can't overrun it.
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				return nil, fmt.Errorf("%w: ConnectBudgetSeconds of %d used up after %d of %d servers: %s",
+					errConnect, config.ConnectBudgetSeconds, i, len(servers), err)
+			}
+			if share := remaining / time.Duration(len(servers)-i); share < timeout {
+				timeout = share
+			}
+		}
+		var l *conn
+		l, err = connectServer(config, server, timeout)
+		if err == nil {
+			if i > 0 && config.PreferNearestServer && config.NearestServerCacheFile != "" {
+				// The cached choice is down; probe again next time.
+				os.Remove(config.NearestServerCacheFile)
+			}
+			if config.ReferralServer != nil {
+				referralServer := *config.ReferralServer
+				if referralServer.Port == 0 {
+					referralServer.Port = config.LDAPPort
+				}
+				l.connectReferral = func() (*conn, error) {
+					return connectServer(config, referralServer, dialTimeout(config))
+				}
+			}
+			if config.ConnectBudgetSeconds > 0 {
+				l.budgetDeadline = deadline
+			}
+			return l, nil
+		}
+		if len(servers) > 1 {
+			log.Printf("Unable to connect to %s: %s", server.Host, err)
+			if i < len(servers)-1 && !retryable(err) {
+				log.Printf("Not trying the remaining servers: this error won't go away by itself")
+				return nil, err
+			}
+		}
+	}
+	return nil, err
+}
+
+// switchServer replaces l's connection with one to another of the
+// LDAPServers, leaving l connected where it was if none of them answers.
+func (l *conn) switchServer(config AuthkeysConfig) error {
+	err := fmt.Errorf("No other server in LDAPServers")
+	for _, server := range orderedServers(config) {
+		if server.Host == l.host {
+			continue
+		}
+		timeout := dialTimeout(config)
+		if !l.budgetDeadline.IsZero() {
+			remaining := time.Until(l.budgetDeadline)
+			if remaining <= 0 {
+				return fmt.Errorf("ConnectBudgetSeconds of %d used up", config.ConnectBudgetSeconds)
+			}
+			if remaining < timeout {
+				timeout = remaining
+			}
+		}
+		var other *conn
+		other, err = connectServer(config, server, timeout)
+		if err == nil {
+			other.connectReferral = l.connectReferral
+			other.budgetDeadline = l.budgetDeadline
+			l.Close()
+			*l = *other
+			return nil
+		}
+	}
+	return err
+}
+
+// startupJitter waits a random time of up to StartupJitterMs, so that a
+// fleet of hosts started together doesn't reach the directory all at once.
+func startupJitter(config AuthkeysConfig) {
+	start := time.Now()
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	time.Sleep(time.Duration(rng.Int63n(int64(config.StartupJitterMs)+1)) * time.Millisecond)
+	traceStep("jitter", start, "", nil)
+}
+
+// retryable reports whether a failure to connect to one server is worth
+// trying the next server for. Servers can differ in their certificates, TLS
+// settings and reachability, so that is almost any failure. Only rejected
+// bind credentials are the same on every server.
+func retryable(err error) bool {
+	var ldapErr *ldap.Error
+	if errors.Is(err, errBind) && errors.As(err, &ldapErr) {
+		switch ldapErr.ResultCode {
+		case ldap.LDAPResultInvalidCredentials, ldap.LDAPResultInappropriateAuthentication:
+			return false
+		}
+	}
+	return true
+}
+
+// dialTimeout is how long to wait for a server to accept a connection and,
+// for LDAPS, complete the TLS handshake.
+func dialTimeout(config AuthkeysConfig) time.Duration {
+	// The LDAP library does have a Dial function that does most of what we
+	// need -- but its default timeout is 60 seconds, which can be annoying if
+	// we're testing something in, say, Vagrant
+	if config.DialTimeout != 0 {
+		return time.Duration(config.DialTimeout) * time.Second
+	}
+	return time.Duration(5) * time.Second
+}
+
+// connectServer dials server, secures the connection with either LDAPS or
+// StartTLS and binds if a BindDN is configured. conntimeout bounds the dial
+// and the LDAPS handshake.
+func connectServer(config AuthkeysConfig, ldapServer LDAPServerConfig, conntimeout time.Duration) (*conn, error) {
+	tlsConfig, err := newTLSConfig(config, ldapServer)
+	if err != nil {
+		return nil, err
+	}
+
+	// Begin initial LDAP TCP connection.
+	address := net.JoinHostPort(ldapServer.Host, strconv.Itoa(ldapServer.Port))
+	start := time.Now()
+	server, err := net.DialTimeout("tcp", address, conntimeout)
+	traceStep("dial", start, fmt.Sprintf("address=%s", address), err)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errConnect, err)
+	}
+	if config.UseLDAPS {
+		// LDAPS negotiates TLS once as part of the connection, saving the
+		// plaintext round trip that StartTLS needs before its handshake.
+		start = time.Now()
+		tlsConn := tls.Client(server, tlsConfig)
+		server.SetDeadline(time.Now().Add(conntimeout))
+		err = tlsConn.Handshake()
+		server.SetDeadline(time.Time{})
+		traceStep("tls-handshake", start, "", err)
+		if err != nil {
+			server.Close()
+			return nil, fmt.Errorf("%w: TLS handshake failed: %w", errConnect, err)
+		}
+		server = tlsConn
+	} else {
+		// StartTLS gets its own deadline, if set, in place of the usual one.
+		timeout := time.Duration(config.OpDeadlineSeconds) * time.Second
+		if config.StartTLSTimeoutSeconds != 0 {
+			timeout = time.Duration(config.StartTLSTimeoutSeconds) * time.Second
+		}
+		start = time.Now()
+		tlsConn, err := startTLS(server, tlsConfig, timeout)
+		traceStep("starttls", start, "", err)
+		if err != nil {
+			server.Close()
+			if !startTLSUnsupported(err) {
+				return nil, fmt.Errorf("%w: StartTLS failed: %w", errConnect, err)
+			}
+			if !config.StartTLSFallbackToLDAPS {
+				return nil, fmt.Errorf("%w: %s does not support StartTLS, set UseLDAPS to connect with LDAPS instead: %w",
+					errConnect, ldapServer.Host, err)
+			}
+			log.Printf("%s does not support StartTLS, falling back to LDAPS on port 636", ldapServer.Host)
+			config.UseLDAPS = true
+			ldapServer.Port = 636
+			return connectServer(config, ldapServer, conntimeout)
+		}
+		server = tlsConn
+	}
+	netConn := newCompareConn(server)
+	l := &conn{
+		Conn:        ldap.NewConn(netConn, true),
+		host:        ldapServer.Host,
+		netConn:     netConn,
+		compares:    netConn.compares,
+		opDeadline:  time.Duration(config.OpDeadlineSeconds) * time.Second,
+		ignoreCodes: config.IgnoreResultCodes,
+	}
+	l.Start()
+
+	// If we have a BindDN go ahead and bind before searching
+	if config.BindDN != "" && config.BindPW != "" {
+		err = l.Bind(config.BindDN, config.BindPW)
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("%w: %w", errBind, err)
+		}
+	}
+	return l, nil
+}
+
+// stripDomainPrefix removes a NetBIOS domain prefix, as in CORP\jdoe, from
+// username when StripDomainPrefix is set. Everything up to the last
+// DomainPrefixSeparator (default a backslash) goes, so stripping twice is
+// harmless.
+func stripDomainPrefix(config AuthkeysConfig, username string) string {
+	if !config.StripDomainPrefix {
+		return username
+	}
+	separator := config.DomainPrefixSeparator
+	if separator == "" {
+		separator = "\\"
+	}
+	if i := strings.LastIndex(username, separator); i >= 0 {
+		return username[i+len(separator):]
+	}
+	return username
+}
+
+// checkUsername refuses usernames that are denylisted or that look like an
+// attempt to inject into the LDAP filter. Refusals are logged with a stable
+// AUTHKEYS_DENY prefix so tools like fail2ban can match on them.
+func checkUsername(config AuthkeysConfig, username string) error {
+	reason := ""
+	for _, denied := range config.DenyUsers {
+		if username == denied {
+			reason = "denylisted"
+			break
+		}
+	}
+	if reason == "" && strings.IndexFunc(username, func(r rune) bool {
+		return strings.ContainsRune("()*\\", r) || r < 0x20 || r == 0x7f
+	}) >= 0 {
+		reason = "injection"
+	}
+	if reason == "" {
+		return nil
+	}
+	log.Printf("AUTHKEYS_DENY reason=%s user=%q", reason, username)
+	return fmt.Errorf("Refusing to look up user %q: %s", username, reason)
+}
+
+// isServiceAccount reports whether username should be looked up in the
+// service account subtree rather than under BaseDN.
+func isServiceAccount(config AuthkeysConfig, username string) bool {
+	return config.ServiceAccountBaseDN != "" && config.ServiceAccountPrefix != "" &&
+		strings.HasPrefix(username, config.ServiceAccountPrefix)
+}
+
+// userFilter builds the search filter for a single user, matching either
+// attribute or, if configured, AliasAttribute.
+func userFilter(config AuthkeysConfig, attribute, username string) string {
+	username = ldap.EscapeFilter(username)
+	filter := matchAssertion(config, attribute, username)
+	if config.AliasAttribute != "" {
+		filter = fmt.Sprintf("(|%s%s)", filter, matchAssertion(config, config.AliasAttribute, username))
+	}
+	if config.UserFilterExtra != "" {
+		filter = fmt.Sprintf("(&%s%s)", filter, config.UserFilterExtra)
+	}
+	return filter
+}
+
+// matchAssertion tests attribute for value, an already escaped filter value,
+// with an extensible match if MatchingRules names a rule for the attribute
+// and a plain equality match otherwise.
+func matchAssertion(config AuthkeysConfig, attribute, value string) string {
+	for name, rule := range config.MatchingRules {
+		if strings.EqualFold(name, attribute) {
+			return fmt.Sprintf("(%s:%s:=%s)", attribute, rule, value)
+		}
+	}
+	return fmt.Sprintf("(%s=%s)", attribute, value)
+}
+
+// validMatchingRule reports whether rule is a matching rule name such as
+// caseExactMatch or a numeric OID such as 2.5.13.5.
+func validMatchingRule(rule string) bool {
+	if rule == "" {
+		return false
+	}
+	if rule[0] >= '0' && rule[0] <= '9' {
+		for _, arc := range strings.Split(rule, ".") {
+			if _, err := strconv.ParseUint(arc, 10, 64); err != nil || (len(arc) > 1 && arc[0] == '0') {
+				return false
+			}
+		}
+		return true
+	}
+	for i, c := range rule {
+		letter := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+		if !letter && (i == 0 || !(c >= '0' && c <= '9' || c == '-')) {
+			return false
+		}
+	}
+	return true
+}
+
+// timestampLayouts are the formats accepted for timestamps stored in the
+// directory: LDAP GeneralizedTime in its common forms, and RFC 3339.
+var timestampLayouts = []string{
+	"20060102150405Z0700",
+	"200601021504Z0700",
+	time.RFC3339,
+}
+
+// clockSkew is how long after an expiry time keys are still accepted, to
+// allow for the host's clock running ahead of the directory's.
+func clockSkew(config AuthkeysConfig) time.Duration {
+	return time.Duration(config.ClockSkewSeconds) * time.Second
+}
+
+// parseTimestamp parses a timestamp attribute value from the directory.
+func parseTimestamp(value string) (time.Time, error) {
+	for _, layout := range timestampLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized timestamp %q", value)
+}
+
+// findUser searches baseDN for the single entry matching username. With
+// UserAttributeCandidates set, each attribute is tried as its own search
+// in order, and the first one that matches exactly one entry is used.
+func findUser(l *conn, config AuthkeysConfig, baseDN, username string, attributes []string) (*ldap.Entry, error) {
+	candidates := config.UserAttributeCandidates
+	if len(candidates) == 0 {
+		candidates = []string{config.UserAttribute}
+	}
+	err := errUserNotFound
+	for _, candidate := range candidates {
+		// Set up an LDAP search and actually do the search
+		searchRequest := ldap.NewSearchRequest(
+			baseDN,
+			ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+			userFilter(config, candidate, username),
+			attributes,
+			nil,
+		)
+
+		sr, searchErr := l.Search(searchRequest)
+		if searchErr != nil {
+			return nil, searchErr
+		}
+		explainf("Search of %s for %s matched %d entries", baseDN, searchRequest.Filter, len(sr.Entries))
+		if len(sr.Entries) == 1 {
+			explainf("Found user %s", sr.Entries[0].DN)
+			return sr.Entries[0], nil
+		} else if len(sr.Entries) > 1 {
+			if entry := pickEntry(config, sr.Entries); entry != nil {
+				log.Printf("%d entries matched %s, using %s per MultipleEntryPolicy %q",
+					len(sr.Entries), username, entry.DN, config.MultipleEntryPolicy)
+				explainf("Using %s per MultipleEntryPolicy %q", entry.DN, config.MultipleEntryPolicy)
+				return entry, nil
+			}
+			err = errMultipleUsers
+		}
+	}
+	return nil, err
+}
+
+// findUserRetrying is findUser, searching again up to EmptyResultRetries
+// times, EmptyResultRetryMillis (default 500) apart, while no entry matches.
+// A user provisioned moments ago may not have replicated to every server
+// yet. With EmptyResultRetryOtherServer, each retry moves to another of the
+// LDAPServers first. No retry starts that would wait past the end of
+// ConnectBudgetSeconds.
+func findUserRetrying(l *conn, config AuthkeysConfig, baseDN, username string, attributes []string) (*ldap.Entry, error) {
+	entry, err := findUser(l, config, baseDN, username, attributes)
+	delay := 500 * time.Millisecond
+	if config.EmptyResultRetryMillis != 0 {
+		delay = time.Duration(config.EmptyResultRetryMillis) * time.Millisecond
+	}
+	for retry := 1; retry <= config.EmptyResultRetries && errors.Is(err, errUserNotFound); retry++ {
+		if !l.budgetDeadline.IsZero() && time.Now().Add(delay).After(l.budgetDeadline) {
+			log.Printf("Not searching for %s again: ConnectBudgetSeconds of %d would be used up", username, config.ConnectBudgetSeconds)
+			break
+		}
+		time.Sleep(delay)
+		if config.EmptyResultRetryOtherServer {
+			if switchErr := l.switchServer(config); switchErr != nil {
+				log.Printf("Unable to move off %s to search for %s again: %s", l.host, username, switchErr)
+			}
+		}
+		log.Printf("No entries for %s, searching %s again (retry %d of %d)", username, l.host, retry, config.EmptyResultRetries)
+		explainf("Searching %s again (retry %d of %d)", l.host, retry, config.EmptyResultRetries)
+		entry, err = findUser(l, config, baseDN, username, attributes)
+	}
+	return entry, err
+}
+
+// pickEntry chooses between several entries matching one user according to
+// MultipleEntryPolicy, returning nil if the policy doesn't settle it. With
+// "union", the result is a single entry carrying the values of all of them.
+func pickEntry(config AuthkeysConfig, entries []*ldap.Entry) *ldap.Entry {
+	policy := config.MultipleEntryPolicy
+	switch {
+	case policy == "first":
+		return entries[0]
+	case policy == "union":
+		return unionEntries(entries)
+	case strings.HasPrefix(policy, "prefer-base "):
+		base := strings.ToLower(strings.TrimSpace(strings.TrimPrefix(policy, "prefer-base ")))
+		var preferred *ldap.Entry
+		for _, entry := range entries {
+			dn := strings.ToLower(entry.DN)
+			if dn == base || strings.HasSuffix(dn, ","+base) {
+				if preferred != nil {
+					return nil
+				}
+				preferred = entry
+			}
+		}
+		return preferred
+	}
+	return nil
+}
+
+// unionEntries merges entries into one with the DN of the first and, for
+// each attribute, every distinct value from any of them.
+func unionEntries(entries []*ldap.Entry) *ldap.Entry {
+	attributes := make(map[string][]string)
+	seen := make(map[string]bool)
+	for _, entry := range entries {
+		for _, attribute := range entry.Attributes {
+			for _, value := range attribute.Values {
+				if key := attribute.Name + "\x00" + value; !seen[key] {
+					seen[key] = true
+					attributes[attribute.Name] = append(attributes[attribute.Name], value)
+				}
+			}
+		}
+	}
+	return ldap.NewEntry(entries[0].DN, attributes)
+}
+
+// attributeType returns attribute without any options or range, as in
+// sshPublicKey for sshPublicKey;x-rotation=current.
+func attributeType(attribute string) string {
+	if i := strings.Index(attribute, ";"); i >= 0 {
+		return attribute[:i]
+	}
+	return attribute
+}
+
+// attributeValues returns the values of attribute from entry. attribute may
+// carry options, as in sshPublicKey;x-rotation=current, in which case only
+// values tagged with all of those options are returned. Without options it
+// is the same as entry.GetAttributeValues.
+func attributeValues(entry *ldap.Entry, attribute string) []string {
+	wanted := strings.Split(attribute, ";")
+	if len(wanted) == 1 {
+		return entry.GetAttributeValues(attribute)
+	}
+	var values []string
+	for _, attr := range entry.Attributes {
+		have := strings.Split(attr.Name, ";")
+		if !strings.EqualFold(have[0], attributeType(attribute)) {
+			continue
+		}
+		matched := true
+		for _, option := range wanted[1:] {
+			found := false
+			for _, tag := range have[1:] {
+				if strings.EqualFold(tag, option) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			values = append(values, attr.Values...)
+		}
+	}
+	return values
+}
+
+// hostName returns the name of this host as used for AllowedHostsAttribute.
+func hostName(config AuthkeysConfig) (string, error) {
+	if config.HostName != "" {
+		return config.HostName, nil
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("Unable to determine hostname: %s", err)
+	}
+	return host, nil
+}
+
+// hostAllowed reports whether host appears in allowed. Values can be plain
+// hostnames or DNs such as FreeIPA's fqdn=host.example.com,cn=computers,...
+// in which case the value of the first RDN is compared.
+func hostAllowed(allowed []string, host string) bool {
+	for _, value := range allowed {
+		if dn, err := ldap.ParseDN(value); err == nil && len(dn.RDNs) > 0 && len(dn.RDNs[0].Attributes) > 0 {
+			value = dn.RDNs[0].Attributes[0].Value
+		}
+		if strings.EqualFold(value, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// scheduleWindow is one AccessScheduleAttribute value: the days of the week
+// it applies to and the minutes after midnight it starts and ends. A window
+// that ends before it starts runs past midnight into the next day.
+type scheduleWindow struct {
+	days       [7]bool
+	start, end int
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parseScheduleWindow parses a window such as "Mon-Fri 09:00-17:30" or
+// "Sat,Sun 10:00-14:00". The days may be "*" for every day, and ranges of
+// days may wrap, as in "Fri-Mon".
+func parseScheduleWindow(value string) (scheduleWindow, error) {
+	var window scheduleWindow
+	fields := strings.Fields(value)
+	if len(fields) != 2 {
+		return window, fmt.Errorf("%q is not of the form \"Mon-Fri 09:00-17:00\"", value)
+	}
+	for _, days := range strings.Split(fields[0], ",") {
+		if days == "*" {
+			window.days = [7]bool{true, true, true, true, true, true, true}
+			continue
+		}
+		first, last, isRange := strings.Cut(strings.ToLower(days), "-")
+		from, fromOK := weekdays[first]
+		to, toOK := from, fromOK
+		if isRange {
+			to, toOK = weekdays[last]
+		}
+		if !fromOK || !toOK {
+			return window, fmt.Errorf("%q in %q is not a day of the week", days, value)
+		}
+		for day := from; ; day = (day + 1) % 7 {
+			window.days[day] = true
+			if day == to {
+				break
+			}
+		}
+	}
+	start, end, ok := strings.Cut(fields[1], "-")
+	var startErr, endErr error
+	window.start, startErr = minuteOfDay(start)
+	window.end, endErr = minuteOfDay(end)
+	if !ok || startErr != nil || endErr != nil || window.start == window.end || window.start == 24*60 {
+		return window, fmt.Errorf("%q in %q is not a time range such as 09:00-17:00", fields[1], value)
+	}
+	return window, nil
+}
+
+// minuteOfDay parses a time such as "17:30" as minutes after midnight.
+// "24:00" is allowed as the end of the day.
+func minuteOfDay(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		if value == "24:00" {
+			return 24 * 60, nil
+		}
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// scheduleAllows reports whether now falls within any of windows, widened by
+// skew at both ends. If not, it also returns when the next window starts.
+func scheduleAllows(windows []scheduleWindow, now time.Time, skew time.Duration) (bool, time.Time) {
+	var next time.Time
+	// Starting a day back catches windows that run past midnight.
+	for offset := -1; offset <= 7; offset++ {
+		year, month, day := now.AddDate(0, 0, offset).Date()
+		for _, window := range windows {
+			start := time.Date(year, month, day, 0, window.start, 0, 0, now.Location())
+			if !window.days[start.Weekday()] {
+				continue
+			}
+			endDay := day
+			if window.end < window.start {
+				endDay++
+			}
+			end := time.Date(year, month, endDay, 0, window.end, 0, 0, now.Location())
+			if !now.Before(start.Add(-skew)) && now.Before(end.Add(skew)) {
+				return true, time.Time{}
+			}
+			if start.After(now) && (next.IsZero() || start.Before(next)) {
+				next = start
+			}
+		}
+	}
+	return false, next
+}
+
+// runPreLookup runs PreLookupCommand with username as its final argument and
+// on stdin. Unless it exits zero within PreLookupTimeoutSeconds (default 5),
+// the user gets no keys.
+func runPreLookup(config AuthkeysConfig, username string) error {
+	timeout := 5 * time.Second
+	if config.PreLookupTimeoutSeconds != 0 {
+		timeout = time.Duration(config.PreLookupTimeoutSeconds) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	args := append(append([]string(nil), config.PreLookupCommand[1:]...), username)
+	cmd := exec.CommandContext(ctx, config.PreLookupCommand[0], args...)
+	cmd.Stdin = strings.NewReader(username + "\n")
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	start := time.Now()
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %s", timeout)
+	}
+	if err != nil {
+		log.Printf("AUTHKEYS_DENY reason=pre-lookup user=%q duration=%s error=%q", username, time.Since(start), err)
+		return fmt.Errorf("PreLookupCommand refused %s: %s", username, err)
+	}
+	log.Printf("PreLookupCommand allowed %s in %s", username, time.Since(start))
+	explainf("PreLookupCommand allowed %s", username)
+	return nil
+}
+
+// inRequiredGroup reports whether the user at entry is a member of
+// RequiredGroup, which may be given as a DN or as a group name. By default
+// the user's memberOf values are checked; with RequiredGroupStyle
+// "memberUid" the group is searched for a memberUid of uid instead, and with
+// "compare" the server is asked to compare the user's memberOf with the
+// group DN, built from GroupObject and BaseDN for a group name.
+func inRequiredGroup(l *conn, config AuthkeysConfig, entry *ldap.Entry, uid string) (bool, error) {
+	group := config.RequiredGroup
+	isDN := strings.Contains(group, "=")
+
+	if config.RequiredGroupStyle == "compare" {
+		if !isDN {
+			group = fmt.Sprintf("cn=%s,ou=%s,%s", group, config.GroupObject, config.BaseDN)
+		}
+		return l.Compare(entry.DN, attributeName(config, "MemberOf"), group)
+	}
+
+	if config.RequiredGroupStyle != "memberUid" {
+		for _, value := range entry.GetAttributeValues(attributeName(config, "MemberOf")) {
+			if strings.EqualFold(value, group) {
+				return true, nil
+			}
+			if isDN {
+				continue
+			}
+			if dn, err := ldap.ParseDN(value); err == nil && len(dn.RDNs) > 0 && len(dn.RDNs[0].Attributes) > 0 &&
+				strings.EqualFold(dn.RDNs[0].Attributes[0].Value, group) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	baseDN, scope := config.BaseDN, ldap.ScopeWholeSubtree
+	filter := fmt.Sprintf("(&(cn=%s)(memberUid=%s))", ldap.EscapeFilter(group), ldap.EscapeFilter(uid))
+	if isDN {
+		baseDN, scope = group, ldap.ScopeBaseObject
+		filter = fmt.Sprintf("(memberUid=%s)", ldap.EscapeFilter(uid))
+	}
+	sr, err := l.Search(ldap.NewSearchRequest(
+		baseDN,
+		scope, ldap.NeverDerefAliases, 0, 0, true,
+		filter,
+		[]string{"1.1"}, // RFC 4511: request no attributes
+		nil,
+	))
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return len(sr.Entries) > 0, nil
+}
+
+// lookupOptions are the settings for a key lookup that come from the command
+// line rather than the configuration.
+type lookupOptions struct {
+	// ShowSuppressed prints expired and dropped keys as comments instead of
+	// leaving them out.
+	ShowSuppressed bool
+	// Principals returns the user's PrincipalAttribute values, for
+	// -mode principals, instead of their keys.
+	Principals bool
+}
+
+// lookupKeys searches for a single user and returns the values of their
+// KeyAttribute. Any domain prefix is stripped from username before it is
+// checked, and the configured UserPostfix is appended for the search. A user
+// who is found but has no keys left to serve is errNoKeys.
+func lookupKeys(l *conn, config AuthkeysConfig, username string, options lookupOptions) ([]string, error) {
+	username = stripDomainPrefix(config, username)
+	if err := checkUsername(config, username); err != nil {
+		return nil, err
+	}
+	if len(config.PreLookupCommand) > 0 {
+		if err := runPreLookup(config, username); err != nil {
+			return nil, err
+		}
+	}
+	baseDN := config.BaseDN
+	keyAttribute := config.KeyAttribute
+	if isServiceAccount(config, username) {
+		explainf("%s is a service account (prefix %q)", username, config.ServiceAccountPrefix)
+		baseDN = config.ServiceAccountBaseDN
+		if config.ServiceAccountKeyAttribute != "" {
+			keyAttribute = config.ServiceAccountKeyAttribute
+		}
+	}
+	keyAttributes := append([]string{keyAttribute}, config.KeyAttributeFallbacks...)
+	attributes := keyAttributes
+	if options.Principals {
+		attributes = []string{config.PrincipalAttribute}
+	}
+	if config.KeyValidityAttribute != "" {
+		attributes = append(attributes, config.KeyValidityAttribute)
+	}
+	if config.KeyOptionsAttribute != "" {
+		attributes = append(attributes, config.KeyOptionsAttribute)
+	}
+	if config.MaxRecentKeys > 0 && config.KeyTimestampAttribute != "" {
+		attributes = append(attributes, config.KeyTimestampAttribute)
+	}
+	if config.ExpectedObjectClass != "" {
+		attributes = append(attributes, "objectClass")
+	}
+	if config.AllowedHostsAttribute != "" {
+		attributes = append(attributes, config.AllowedHostsAttribute)
+	}
+	if config.AccessScheduleAttribute != "" {
+		attributes = append(attributes, config.AccessScheduleAttribute)
+	}
+	if config.FromCIDRAttribute != "" {
+		attributes = append(attributes, config.FromCIDRAttribute)
+	}
+	if config.RequiredGroup != "" && config.RequiredGroupStyle != "memberUid" && config.RequiredGroupStyle != "compare" {
+		attributes = append(attributes, attributeName(config, "MemberOf"))
+	}
+	uid := username
+	username += config.UserPostfix
+
+	entry, err := findUserRetrying(l, config, baseDN, username, attributes)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.ExpectedObjectClass != "" {
+		classes := entry.GetAttributeValues("objectClass")
+		found := false
+		for _, class := range classes {
+			if strings.EqualFold(class, config.ExpectedObjectClass) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("Refusing keys from %s: objectClass %s does not include %s",
+				entry.DN, strings.Join(classes, ","), config.ExpectedObjectClass)
+		}
+	}
+
+	expired := ""
+	var expiry time.Time
+	if config.KeyValidityAttribute != "" {
+		notAfter := entry.GetAttributeValue(config.KeyValidityAttribute)
+		if notAfter != "" {
+			var err error
+			expiry, err = parseTimestamp(notAfter)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to parse %s for %s: %s", config.KeyValidityAttribute, username, err)
+			}
+			if time.Now().Add(-clockSkew(config)).After(expiry) {
+				if !options.ShowSuppressed {
+					return nil, fmt.Errorf("Keys for %s expired at %s", username, expiry.Format(time.RFC3339))
+				}
+				expired = "expired at " + expiry.Format(time.RFC3339)
+			}
+			explainf("Keys are valid until %s", expiry.Format(time.RFC3339))
+		} else {
+			explainf("No %s, so the keys never expire", config.KeyValidityAttribute)
+		}
+	}
+
+	if config.AllowedHostsAttribute != "" {
+		host, err := hostName(config)
+		if err != nil {
+			return nil, err
+		}
+		if !hostAllowed(entry.GetAttributeValues(config.AllowedHostsAttribute), host) {
+			return nil, fmt.Errorf("%s is not allowed to log in to %s", username, host)
+		}
+		explainf("%s may log in to %s", username, host)
+	}
+
+	if config.RequiredGroup != "" {
+		member, err := inRequiredGroup(l, config, entry, uid)
+		if err != nil {
+			return nil, err
+		}
+		if !member {
+			log.Printf("AUTHKEYS_DENY reason=required-group user=%q group=%q", username, config.RequiredGroup)
+			return nil, fmt.Errorf("%s is not a member of %s", username, config.RequiredGroup)
+		}
+		explainf("%s is a member of %s", username, config.RequiredGroup)
+	}
+
+	if config.AccessScheduleAttribute != "" {
+		values := entry.GetAttributeValues(config.AccessScheduleAttribute)
+		if len(values) > 0 {
+			var windows []scheduleWindow
+			for _, value := range values {
+				window, err := parseScheduleWindow(value)
+				if err != nil {
+					return nil, fmt.Errorf("Unable to parse %s for %s: %s", config.AccessScheduleAttribute, username, err)
+				}
+				windows = append(windows, window)
+			}
+			allowed, next := scheduleAllows(windows, time.Now(), clockSkew(config))
+			if !allowed {
+				log.Printf("AUTHKEYS_DENY reason=schedule user=%q next=%s", username, next.Format(time.RFC3339))
+				return nil, fmt.Errorf("%s is outside their %s, next window starts %s",
+					username, config.AccessScheduleAttribute, next.Format(time.RFC3339))
+			}
+			explainf("%s is within their %s", username, config.AccessScheduleAttribute)
+		} else {
+			explainf("No %s, so %s may log in at any time", config.AccessScheduleAttribute, username)
+		}
+	}
+
+	from := ""
+	if config.FromCIDRAttribute != "" {
+		from, err = fromOption(config, entry, username)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if options.Principals {
+		return userPrincipals(config, entry, username, expiry, expired, from), nil
+	}
+
+	// Get the keys. This will only return keys for the first user returned
+	// from LDAP, but if you have multiple users with the same name maybe
+	// setting a different BaseDN may be useful. The first key attribute with
+	// any values wins; the fallbacks are not merged in.
+	var values []string
+	for _, attribute := range keyAttributes {
+		values = attributeValues(entry, attribute)
+		explainf("%s has %d values", attribute, len(values))
+		if len(values) > 0 {
+			break
+		}
+	}
+	keys, origins := keyLines(config, username, values)
+	if config.KeyOptionsAttribute != "" {
+		keys = applyKeyOptions(keys, origins, len(values), entry.GetAttributeValues(config.KeyOptionsAttribute))
+	}
+	if config.MaxRecentKeys > 0 && len(keys) > config.MaxRecentKeys {
+		keys = recentKeys(config, entry, username, keys, origins, len(values))
+	}
+	if config.KeyExpiryTimeOption && !expiry.IsZero() && expired == "" {
+		option := expiryTimeOption(config, expiry)
+		for i, key := range keys {
+			keys[i] = prependKeyOption(key, option)
+		}
+	}
+	if from != "" {
+		for i, key := range keys {
+			keys[i] = prependKeyOption(key, from)
+		}
+	}
+	if config.RestrictKeys {
+		// restrict has to come first, or it would also switch off whatever
+		// the options already on a key allowed.
+		option := restrictOption(config)
+		for i, key := range keys {
+			keys[i] = prependKeyOption(key, option)
+		}
+	}
+	keys = dropLongKeys(config, username, keys, options)
+	if len(config.AllowedECDSACurves) > 0 {
+		keys = dropDisallowedCurves(config, username, keys, options)
+	}
+	if len(config.KeyTypeOrder) > 0 {
+		sortKeysByType(keys, config.KeyTypeOrder)
+	}
+	if expired != "" {
+		for i, key := range keys {
+			if !strings.HasPrefix(key, "#") {
+				keys[i] = suppressedKey(expired, key)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%w for %s", errNoKeys, username)
+	}
+	return keys, nil
+}
+
+// keyLines turns the values of a key attribute into authorized_keys lines,
+// converting PEM-wrapped keys and splitting multi-line values as configured.
+// origins holds, for each line, the index of the value it came from.
+func keyLines(config AuthkeysConfig, username string, values []string) (keys []string, origins []int) {
+	for i, value := range values {
+		lines := convertPEMKeys(config, username, []string{value})
+		if config.SplitKeyValuesOnNewline {
+			lines = splitKeyValues(lines)
+		}
+		for range lines {
+			origins = append(origins, i)
+		}
+		keys = append(keys, lines...)
+	}
+	return keys, origins
+}
+
+// fromOption builds a from="..." option restricting a user's keys to the
+// networks in their FromCIDRAttribute, skipping values that aren't CIDRs. It
+// returns "" for a user with no values, and an error for one whose values
+// are all invalid, rather than serving their keys unrestricted.
+func fromOption(config AuthkeysConfig, entry *ldap.Entry, username string) (string, error) {
+	values := entry.GetAttributeValues(config.FromCIDRAttribute)
+	var networks []string
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if _, _, err := net.ParseCIDR(value); err != nil {
+			log.Printf("Warning: skipping %s value %q of %s: %s", config.FromCIDRAttribute, value, username, err)
+			continue
+		}
+		networks = append(networks, value)
+	}
+	if len(networks) == 0 {
+		if len(values) > 0 {
+			return "", fmt.Errorf("Refusing keys for %s: none of their %s values is a valid CIDR", username, config.FromCIDRAttribute)
+		}
+		explainf("No %s, so the keys may be used from anywhere", config.FromCIDRAttribute)
+		return "", nil
+	}
+	explainf("Keys may only be used from %s", strings.Join(networks, ","))
+	return fmt.Sprintf("from=%q", strings.Join(networks, ",")), nil
+}
+
+// restrictReenables are the authorized_keys options that turn a capability
+// back on after restrict.
+var restrictReenables = []string{"agent-forwarding", "port-forwarding", "pty", "user-rc", "X11-forwarding"}
+
+func restrictReenable(option string) bool {
+	for _, reenable := range restrictReenables {
+		if strings.EqualFold(option, reenable) {
+			return true
+		}
+	}
+	return false
+}
+
+// restrictOption is restrict followed by the capabilities RestrictOptions
+// re-enables, such as "restrict,pty".
+func restrictOption(config AuthkeysConfig) string {
+	return strings.Join(append([]string{"restrict"}, config.RestrictOptions...), ",")
+}
+
+// expiryTimeOption is the authorized_keys option that has sshd itself refuse
+// a key after expiry.
+func expiryTimeOption(config AuthkeysConfig, expiry time.Time) string {
+	// Without a Z, sshd reads the time in the system time zone, which every
+	// OpenSSH version with expiry-time understands.
+	return fmt.Sprintf("expiry-time=%q", expiry.Add(clockSkew(config)).Local().Format("200601021504"))
+}
+
+// userPrincipals returns the PrincipalAttribute values of entry as
+// AuthorizedPrincipalsCommand lines, with the same expiry handling and from
+// option that lookupKeys gives keys.
+func userPrincipals(config AuthkeysConfig, entry *ldap.Entry, username string, expiry time.Time, expired, from string) []string {
+	values := attributeValues(entry, config.PrincipalAttribute)
+	explainf("%s has %d values", config.PrincipalAttribute, len(values))
+	var principals []string
+	for _, principal := range values {
+		// sshd would read everything before the last space as options.
+		if strings.ContainsAny(principal, " \t") {
+			log.Printf("Warning: skipping principal %q of %s: contains whitespace", principal, username)
+			continue
+		}
+		var options []string
+		if config.RestrictKeys {
+			options = append(options, restrictOption(config))
+		}
+		if config.KeyExpiryTimeOption && !expiry.IsZero() && expired == "" {
+			options = append(options, expiryTimeOption(config, expiry))
+		}
+		if from != "" {
+			options = append(options, from)
+		}
+		if len(options) > 0 {
+			principal = strings.Join(options, ",") + " " + principal
+		}
+		if expired != "" {
+			principal = suppressedKey(expired, principal)
+		}
+		principals = append(principals, principal)
+	}
+	return principals
+}
+
+// suppressedKey comments out a key that -show-suppressed would otherwise
+// have dropped, noting why, so that sshd ignores it but people can see it.
+func suppressedKey(reason, key string) string {
+	return "# suppressed (" + reason + "): " + key
+}
+
+// recentKeys returns the newest MaxRecentKeys of keys, newest first. Each
+// key's timestamp is the value of KeyTimestampAttribute in the position of
+// the key value it came from, given by origins, or without one, a timestamp
+// or YYYY-MM-DD date in the key's comment. If any key has no timestamp, or
+// the number of KeyTimestampAttribute values doesn't match the number of key
+// values, all the keys are returned.
+func recentKeys(config AuthkeysConfig, entry *ldap.Entry, username string, keys []string, origins []int, values int) []string {
+	var stamps []string
+	if config.KeyTimestampAttribute != "" {
+		stamps = entry.GetAttributeValues(config.KeyTimestampAttribute)
+		if len(stamps) != values {
+			log.Printf("Warning: not limiting %s to %d keys: %d %s values for %d key values",
+				username, config.MaxRecentKeys, len(stamps), config.KeyTimestampAttribute, values)
+			return keys
+		}
+	}
+	created := make([]time.Time, len(keys))
+	for i, key := range keys {
+		var err error
+		if config.KeyTimestampAttribute != "" {
+			created[i], err = parseTimestamp(stamps[origins[i]])
+		} else {
+			created[i], err = commentTimestamp(key)
+		}
+		if err != nil {
+			log.Printf("Warning: not limiting %s to %d keys: key %d: %s", username, config.MaxRecentKeys, i+1, err)
+			return keys
+		}
+	}
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return created[order[a]].After(created[order[b]])
+	})
+	var recent []string
+	for _, i := range order[:config.MaxRecentKeys] {
+		recent = append(recent, keys[i])
+	}
+	return recent
+}
+
+// commentTimestamp finds a timestamp in the comment of an authorized_keys
+// line, such as the 2023-04-01 in "ssh-ed25519 AAAA... jdoe 2023-04-01".
+func commentTimestamp(key string) (time.Time, error) {
+	fields := strings.Fields(key)
+	for i, field := range fields {
+		if keyType(field) != "" && i+2 < len(fields) {
+			// Skip the key type and the key itself.
+			for _, word := range fields[i+2:] {
+				if t, err := parseTimestamp(word); err == nil {
+					return t, nil
+				}
+				if t, err := time.Parse("2006-01-02", word); err == nil {
+					return t, nil
+				}
+			}
+			break
+		}
+	}
+	return time.Time{}, fmt.Errorf("no timestamp in the key comment")
+}
+
+// convertPEMKeys replaces values holding PEM-wrapped public keys, as some
+// tools store them, with the same keys in authorized_keys format. With
+// PEMKeyPolicy "skip" such values are dropped instead. Other values are
+// passed through unchanged.
+func convertPEMKeys(config AuthkeysConfig, username string, values []string) []string {
+	var keys []string
+	for _, value := range values {
+		if !strings.Contains(value, "-----BEGIN ") {
+			keys = append(keys, value)
+			continue
+		}
+		if config.PEMKeyPolicy == "skip" {
+			log.Printf("Warning: skipping a PEM-wrapped key of %s per PEMKeyPolicy", username)
+			continue
+		}
+		rest := []byte(value)
+		for {
+			var block *pem.Block
+			block, rest = pem.Decode(rest)
+			if block == nil {
+				break
+			}
+			key, err := pemAuthorizedKey(block)
+			if err != nil {
+				log.Printf("Warning: skipping a PEM-wrapped key of %s: %s", username, err)
+				continue
+			}
+			explainf("Converted a PEM %s to %s", block.Type, keyType(key))
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// pemAuthorizedKey converts a PEM "PUBLIC KEY" or "RSA PUBLIC KEY" block to
+// an authorized_keys line.
+func pemAuthorizedKey(block *pem.Block) (string, error) {
+	var pub interface{}
+	var err error
+	switch block.Type {
+	case "PUBLIC KEY":
+		pub, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		pub, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return "", fmt.Errorf("%s is not a public key", block.Type)
+	}
+	if err != nil {
+		return "", err
+	}
+	var name string
+	var parts [][]byte
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		name = "ssh-rsa"
+		parts = [][]byte{sshMpint(big.NewInt(int64(pub.E))), sshMpint(pub.N)}
+	case ed25519.PublicKey:
+		name = "ssh-ed25519"
+		parts = [][]byte{pub}
+	case *ecdsa.PublicKey:
+		curve := fmt.Sprintf("nistp%d", pub.Curve.Params().BitSize)
+		if _, ok := ecdsaCurveBits[curve]; !ok {
+			return "", fmt.Errorf("unsupported ECDSA curve %s", pub.Curve.Params().Name)
+		}
+		point, err := pub.ECDH()
+		if err != nil {
+			return "", err
+		}
+		name = "ecdsa-sha2-" + curve
+		parts = [][]byte{[]byte(curve), point.Bytes()}
+	default:
+		return "", fmt.Errorf("unsupported public key type %T", pub)
+	}
+	var blob []byte
+	for _, part := range append([][]byte{[]byte(name)}, parts...) {
+		blob = binary.BigEndian.AppendUint32(blob, uint32(len(part)))
+		blob = append(blob, part...)
+	}
+	return name + " " + base64.StdEncoding.EncodeToString(blob), nil
+}
+
+// sshMpint encodes a non-negative n as the body of an SSH mpint: big-endian,
+// with a leading zero byte when the top bit would otherwise be set.
+func sshMpint(n *big.Int) []byte {
+	b := n.Bytes()
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return b
+}
+
+// splitKeyValues splits attribute values holding several newline-separated
+// keys into one key each, skipping blank lines.
+func splitKeyValues(values []string) []string {
+	var keys []string
+	for _, value := range values {
+		for _, line := range strings.Split(value, "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" {
+				keys = append(keys, line)
+			}
+		}
+	}
+	return keys
+}
+
+// dropLongKeys leaves out key lines longer than MaxKeyLineBytes, which
+// defaults to 16KB, so a corrupt directory value can't make sshd reject the
+// whole output. A negative MaxKeyLineBytes turns the check off.
+func dropLongKeys(config AuthkeysConfig, username string, keys []string, options lookupOptions) []string {
+	limit := config.MaxKeyLineBytes
+	if limit == 0 {
+		limit = 16 * 1024
+	}
+	if limit < 0 {
+		return keys
+	}
+	var kept []string
+	for i, key := range keys {
+		if len(key) > limit {
+			log.Printf("Warning: dropping key %d for %s: %d bytes is over the %d byte limit", i+1, username, len(key), limit)
+			explainf("Dropped key %d: %d bytes is over the %d byte limit", i+1, len(key), limit)
+			if options.ShowSuppressed {
+				// The key itself is what's too long, so only show its start.
+				start := key
+				if len(start) > 80 {
+					start = start[:80]
+				}
+				kept = append(kept, suppressedKey(fmt.Sprintf("%d bytes", len(key)), start+"..."))
+			}
+			continue
+		}
+		kept = append(kept, key)
+	}
+	return kept
+}
+
+// dropDisallowedCurves leaves out ECDSA keys whose curve, as recorded in the
+// key itself, isn't in AllowedECDSACurves. ECDSA keys that can't be parsed
+// are left out too.
+func dropDisallowedCurves(config AuthkeysConfig, username string, keys []string, options lookupOptions) []string {
+	var kept []string
+	for i, key := range keys {
+		kt := keyType(key)
+		if !strings.HasPrefix(kt, "ecdsa-") && !strings.HasPrefix(kt, "sk-ecdsa-") {
+			kept = append(kept, key)
+			continue
+		}
+		curve, err := ecdsaCurve(key)
+		allowed := false
+		for _, allowedCurve := range config.AllowedECDSACurves {
+			if err == nil && curve == allowedCurve {
+				allowed = true
+				break
+			}
+		}
+		if allowed {
+			kept = append(kept, key)
+			continue
+		}
+		reason := "curve " + curve
+		if err != nil {
+			reason = "unreadable curve (" + err.Error() + ")"
+		}
+		log.Printf("Warning: dropping key %d for %s: %s is not in AllowedECDSACurves", i+1, username, reason)
+		explainf("Dropped key %d: %s is not in AllowedECDSACurves", i+1, reason)
+		if options.ShowSuppressed {
+			kept = append(kept, suppressedKey(reason, key))
+		}
+	}
+	return kept
+}
+
+// parsedKey is an authorized_keys line taken apart.
+type parsedKey struct {
+	Options string
+	Type    string
+	Blob    []byte
+	Comment string
+}
+
+// parseKey splits an authorized_keys line into its options, key type,
+// decoded key body and comment.
+func parseKey(key string) (parsedKey, error) {
+	fields := strings.Fields(key)
+	for i, field := range fields {
+		if keyType(field) == "" {
+			continue
+		}
+		if i+1 >= len(fields) {
+			return parsedKey{}, fmt.Errorf("truncated key")
+		}
+		blob, err := base64.StdEncoding.DecodeString(fields[i+1])
+		if err != nil {
+			return parsedKey{}, fmt.Errorf("unparseable key")
+		}
+		return parsedKey{
+			Options: strings.Join(fields[:i], " "),
+			Type:    field,
+			Blob:    blob,
+			Comment: strings.Join(fields[i+2:], " "),
+		}, nil
+	}
+	return parsedKey{}, fmt.Errorf("unparseable key")
+}
+
+// KeyDiff is the -diff report: the keys only the directory would serve and
+// the keys only in the authorized_keys file.
+type KeyDiff struct {
+	OnlyInLDAP []string `json:"only_in_ldap"`
+	OnlyInFile []string `json:"only_in_file"`
+}
+
+// diffKeys compares keys with the lines of an authorized_keys file. Keys are
+// matched on their type and body, so differences in options or comments
+// aren't reported. Blank and comment lines are ignored.
+func diffKeys(keys []string, fileLines []string) KeyDiff {
+	identity := func(key string) string {
+		if parsed, err := parseKey(key); err == nil {
+			return parsed.Type + " " + base64.StdEncoding.EncodeToString(parsed.Blob)
+		}
+		return key
+	}
+	inLDAP := make(map[string]bool)
+	for _, key := range keys {
+		inLDAP[identity(key)] = true
+	}
+	diff := KeyDiff{OnlyInLDAP: []string{}, OnlyInFile: []string{}}
+	inFile := make(map[string]bool)
+	for _, line := range fileLines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		inFile[identity(line)] = true
+		if !inLDAP[identity(line)] {
+			diff.OnlyInFile = append(diff.OnlyInFile, line)
+		}
+	}
+	for _, key := range keys {
+		if !inFile[identity(key)] {
+			diff.OnlyInLDAP = append(diff.OnlyInLDAP, key)
+		}
+	}
+	return diff
+}
+
+// sshStrings reads the first n length-prefixed strings of an SSH wire
+// format key body. The first is always the key type.
+func sshStrings(blob []byte, n int) ([][]byte, error) {
+	var parts [][]byte
+	for len(parts) < n {
+		if len(blob) < 4 {
+			return nil, fmt.Errorf("truncated key")
+		}
+		size := binary.BigEndian.Uint32(blob)
+		if uint64(len(blob)-4) < uint64(size) {
+			return nil, fmt.Errorf("truncated key")
+		}
+		parts = append(parts, blob[4:4+size])
+		blob = blob[4+size:]
+	}
+	return parts, nil
+}
+
+// ecdsaCurve returns the curve name, such as nistp256, from the body of an
+// ECDSA authorized_keys line, where it follows the key type.
+func ecdsaCurve(key string) (string, error) {
+	parsed, err := parseKey(key)
+	if err != nil {
+		return "", err
+	}
+	parts, err := sshStrings(parsed.Blob, 2)
+	if err != nil {
+		return "", err
+	}
+	if string(parts[0]) != parsed.Type {
+		return "", fmt.Errorf("key type mismatch")
+	}
+	return string(parts[1]), nil
+}
+
+// KeyDetail describes one key for -json-detailed.
+type KeyDetail struct {
+	Type        string `json:"type"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	Bits        int    `json:"bits,omitempty"`
+	Curve       string `json:"curve,omitempty"`
+	Comment     string `json:"comment,omitempty"`
+	Expiry      string `json:"expiry,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// ecdsaCurveBits is the key size of each ECDSA curve.
+var ecdsaCurveBits = map[string]int{
+	"nistp256": 256,
+	"nistp384": 384,
+	"nistp521": 521,
+}
+
+// keyDetails describes each of keys, skipping comment lines. Keys that
+// can't be parsed are still listed, with an error.
+func keyDetails(keys []string) []KeyDetail {
+	details := []KeyDetail{}
+	for _, key := range keys {
+		if strings.HasPrefix(key, "#") {
+			continue
+		}
+		detail := KeyDetail{Type: keyType(key)}
+		parsed, err := parseKey(key)
+		if err == nil {
+			sum := sha256.Sum256(parsed.Blob)
+			detail.Fingerprint = "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+			detail.Comment = parsed.Comment
+			detail.Expiry = optionExpiry(parsed.Options)
+			detail.Bits, detail.Curve, err = keySize(parsed)
+		}
+		if err != nil {
+			detail.Error = err.Error()
+		}
+		details = append(details, detail)
+	}
+	return details
+}
+
+// keySize returns the size in bits of a parsed key and, for ECDSA keys, its
+// curve.
+func keySize(parsed parsedKey) (int, string, error) {
+	switch {
+	case strings.Contains(parsed.Type, "ed25519"):
+		return 256, "", nil
+	case strings.Contains(parsed.Type, "ecdsa-"):
+		parts, err := sshStrings(parsed.Blob, 2)
+		if err != nil {
+			return 0, "", err
+		}
+		curve := string(parts[1])
+		return ecdsaCurveBits[curve], curve, nil
+	case parsed.Type == "ssh-rsa":
+		// type, public exponent, modulus
+		parts, err := sshStrings(parsed.Blob, 3)
+		if err != nil {
+			return 0, "", err
+		}
+		return new(big.Int).SetBytes(parts[2]).BitLen(), "", nil
+	case parsed.Type == "ssh-dss":
+		// type, p, q, g, y
+		parts, err := sshStrings(parsed.Blob, 2)
+		if err != nil {
+			return 0, "", err
+		}
+		return new(big.Int).SetBytes(parts[1]).BitLen(), "", nil
+	}
+	return 0, "", nil
+}
+
+// optionExpiry returns the expiry-time option among options as an RFC 3339
+// time, or "" if there isn't one that parses.
+func optionExpiry(options string) string {
+	for _, option := range strings.Split(options, ",") {
+		if !strings.HasPrefix(option, "expiry-time=") {
+			continue
+		}
+		value := strings.Trim(strings.TrimPrefix(option, "expiry-time="), `"`)
+		location := time.Local
+		if strings.HasSuffix(value, "Z") {
+			value, location = strings.TrimSuffix(value, "Z"), time.UTC
+		}
+		for _, layout := range []string{"20060102150405", "200601021504", "20060102"} {
+			if t, err := time.ParseInLocation(layout, value, location); err == nil {
+				return t.Format(time.RFC3339)
+			}
+		}
+	}
+	return ""
+}
+
+// escapeBinary escapes every byte of value for use in an LDAP filter, which
+// is how binary attributes such as objectSid have to be matched.
+func escapeBinary(value []byte) string {
+	var escaped strings.Builder
+	for _, b := range value {
+		fmt.Fprintf(&escaped, "\\%02x", b)
+	}
+	return escaped.String()
+}
+
+// tokenGroupDNs reads the tokenGroups attribute of each of userDNs and
+// resolves the SIDs to group DNs, returning each user's groups by DN.
+// tokenGroups is computed by Active Directory on request and includes nested
+// groups. It is only returned for base-scoped searches, so every user costs
+// a read, but the SIDs of all of them are resolved with a single search.
+// Users whose tokenGroups can't be read are left out of the result.
+func tokenGroupDNs(l *conn, config AuthkeysConfig, userDNs []string) map[string][]string {
+	userSIDs := make(map[string][][]byte)
+	sidDNs := make(map[string]string)
+	filter := "(|"
+	for _, userDN := range userDNs {
+		sr, err := l.Search(ldap.NewSearchRequest(
+			userDN,
+			ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+			"(objectClass=*)",
+			[]string{"tokenGroups"},
+			nil,
+		))
+		if err != nil {
+			log.Printf("Unable to read tokenGroups for %s, falling back to memberOf: %s", userDN, err)
+			continue
+		}
+		if len(sr.Entries) == 0 {
+			continue
+		}
+		sids := sr.Entries[0].GetRawAttributeValues("tokenGroups")
+		userSIDs[userDN] = sids
+		for _, sid := range sids {
+			if _, ok := sidDNs[string(sid)]; !ok {
+				sidDNs[string(sid)] = ""
+				filter += fmt.Sprintf("(objectSid=%s)", escapeBinary(sid))
+			}
+		}
+	}
+	filter += ")"
+
+	if len(sidDNs) > 0 {
+		groupSr, err := l.Search(ldap.NewSearchRequest(
+			config.BaseDN,
+			ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+			filter,
+			[]string{"objectSid"},
+			nil,
+		))
+		if err != nil {
+			log.Printf("Unable to resolve tokenGroups, falling back to memberOf: %s", err)
+			return nil
+		}
+		for _, group := range groupSr.Entries {
+			sidDNs[string(group.GetRawAttributeValue("objectSid"))] = group.DN
+		}
+	}
+	groups := make(map[string][]string)
+	for userDN, sids := range userSIDs {
+		for _, sid := range sids {
+			if dn := sidDNs[string(sid)]; dn != "" {
+				groups[userDN] = append(groups[userDN], dn)
+			}
+		}
+	}
+	return groups
+}
+
+// selectID returns the value of a numeric ID attribute that should be
+// single-valued. If the entry has several values, a warning is logged and
+// one is picked: any value listed in PreferredIDs first, otherwise the
+// first, lowest or highest value depending on IDSelection.
+func selectID(config AuthkeysConfig, entry *ldap.Entry, attribute string) string {
+	values := entry.GetAttributeValues(attribute)
+	if len(values) <= 1 {
+		return entry.GetAttributeValue(attribute)
+	}
+	log.Printf("Warning: %s has %d values for %s: %s", entry.DN, len(values), attribute, strings.Join(values, ", "))
+	for _, preferred := range config.PreferredIDs {
+		for _, value := range values {
+			if value == preferred {
+				return value
+			}
+		}
+	}
+	if config.IDSelection != "lowest" && config.IDSelection != "highest" {
+		return values[0]
+	}
+	selected := values[0]
+	selectedNum, selectedErr := strconv.ParseInt(selected, 10, 64)
+	for _, value := range values[1:] {
+		num, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			continue
+		}
+		if selectedErr != nil ||
+			(config.IDSelection == "lowest" && num < selectedNum) ||
+			(config.IDSelection == "highest" && num > selectedNum) {
+			selected, selectedNum, selectedErr = value, num, nil
+		}
+	}
+	return selected
+}
+
+// expandHomeTemplate substitutes the {uid}, {uidNumber} and {firstletter}
+// placeholders in template with values from user.
+func expandHomeTemplate(template string, user User) string {
+	firstLetter := ""
+	if user.Uid != "" {
+		_, size := utf8.DecodeRuneInString(user.Uid)
+		firstLetter = user.Uid[:size]
+	}
+	return strings.NewReplacer(
+		"{uid}", user.Uid,
+		"{uidNumber}", user.UidNumber,
+		"{firstletter}", firstLetter,
+	).Replace(template)
+}
+
+// applyKeyOptions prefixes the keys from the Nth key value, given by
+// origins, with the Nth options value. Keys without a matching (or with an
+// empty) options value are left unchanged, and extra options values are
+// ignored.
+func applyKeyOptions(keys []string, origins []int, values int, options []string) []string {
+	if len(options) > values {
+		log.Printf("Warning: %d key options values for %d key values, ignoring the extras", len(options), values)
+	}
+	withOptions := make([]string, len(keys))
+	for i, key := range keys {
+		withOptions[i] = key
+		if origin := origins[i]; origin < len(options) && strings.TrimSpace(options[origin]) != "" {
+			withOptions[i] = strings.TrimSpace(options[origin]) + " " + key
+		}
+	}
+	return withOptions
+}
+
+// prependKeyOption adds option in front of any options key already has.
+func prependKeyOption(key, option string) string {
+	fields := strings.Fields(key)
+	if len(fields) > 0 && keyType(fields[0]) == "" {
+		return option + "," + key
+	}
+	return option + " " + key
+}
+
+// keyType returns the key type of an authorized_keys line, such as
+// ssh-ed25519, skipping over any options in front of it.
+func keyType(key string) string {
+	for _, field := range strings.Fields(key) {
+		if strings.HasPrefix(field, "ssh-") || strings.HasPrefix(field, "ecdsa-") || strings.HasPrefix(field, "sk-") {
+			return field
+		}
+	}
+	return ""
+}
+
+// sortKeysByType orders keys by the first entry in order that their key
+// type contains, so "ecdsa" matches every ecdsa-sha2-* type. Keys whose
+// type isn't listed go last, and keys of equal rank keep their order.
+func sortKeysByType(keys []string, order []string) {
+	rank := func(key string) int {
+		kt := keyType(key)
+		for i, preferred := range order {
+			if kt != "" && strings.Contains(kt, preferred) {
+				return i
+			}
+		}
+		return len(order)
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		return rank(keys[i]) < rank(keys[j])
+	})
+}
+
+// defaultAttributeMap holds the LDAP attribute read for each User field
+// unless AttributeMap says otherwise.
+var defaultAttributeMap = map[string]string{
+	"Uid":           "uid",
+	"UidNumber":     "uidNumber",
+	"GidNumber":     "gidNumber",
+	"MemberOf":      "memberOf",
+	"HomeDirectory": "homeDirectory",
+	"Shell":         "loginShell",
+}
+
+// attributeName returns the LDAP attribute to read for the User field.
+func attributeName(config AuthkeysConfig, field string) string {
+	if attribute := config.AttributeMap[field]; attribute != "" {
+		return attribute
+	}
+	return defaultAttributeMap[field]
+}
+
+// uidFromDN stands in for a missing uid attribute when MissingUidPolicy is
+// "dn", returning the value of the first RDN of dn, or "" if there is none.
+func uidFromDN(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil || len(parsed.RDNs) == 0 || len(parsed.RDNs[0].Attributes) == 0 {
+		return ""
+	}
+	return parsed.RDNs[0].Attributes[0].Value
+}
+
+// missingPosixFields lists the posixAccount fields user has no value for.
+func missingPosixFields(user User) []string {
+	var missing []string
+	for _, field := range []struct{ name, value string }{
+		{"uidNumber", user.UidNumber},
+		{"gidNumber", user.GidNumber},
+		{"homeDirectory", user.HomeDirectory},
+		{"loginShell", user.Shell},
+	} {
+		if field.value == "" {
+			missing = append(missing, field.name)
+		}
+	}
+	return missing
+}
+
+// listOptions controls what listGroup fetches and returns.
+type listOptions struct {
+	// Minimal looks up memberOf separately for each user, for directories
+	// that don't return it from the group search.
+	Minimal bool
+	// WithDN includes each user's DN.
+	WithDN bool
+	// StrictIDs makes an invalid uidNumber or gidNumber fatal rather than
+	// skipping the user.
+	StrictIDs bool
+	// UidCollisions is "warn" to log members that share a uidNumber, or
+	// "fail" to return an error instead.
+	UidCollisions string
+}
+
+// validateIDs checks that the user's uidNumber and gidNumber are integers
+// within MinUID and MaxUID (when set).
+func validateIDs(config AuthkeysConfig, user User) error {
+	for _, id := range []struct{ name, value string }{
+		{"uidNumber", user.UidNumber},
+		{"gidNumber", user.GidNumber},
+	} {
+		num, err := strconv.Atoi(id.value)
+		if err != nil {
+			return fmt.Errorf("%s has invalid %s %q", user.Uid, id.name, id.value)
+		}
+		if (config.MinUID != 0 && num < config.MinUID) || (config.MaxUID != 0 && num > config.MaxUID) {
+			return fmt.Errorf("%s has %s %d outside the allowed range %d-%d", user.Uid, id.name, num, config.MinUID, config.MaxUID)
+		}
+	}
+	return nil
+}
+
+// groupFilter builds the search filter matching the members of group. With
+// RequireKeyPresent, only members with a value in KeyAttribute or one of its
+// fallbacks match; a presence filter can't carry attribute options, so any
+// are left off.
+func groupFilter(config AuthkeysConfig, group string) string {
+	keyPresent := ""
+	if config.RequireKeyPresent {
+		for _, attribute := range append([]string{config.KeyAttribute}, config.KeyAttributeFallbacks...) {
+			keyPresent += fmt.Sprintf("(%s=*)", attributeType(attribute))
+		}
+		if len(config.KeyAttributeFallbacks) > 0 {
+			keyPresent = "(|" + keyPresent + ")"
+		}
+	}
+	return fmt.Sprintf("(&(objectClass=inetOrgPerson)(%s=cn=%s,ou=%s,%s)%s%s)",
+		attributeName(config, "MemberOf"), group, config.GroupObject, config.BaseDN, keyPresent, config.GroupFilterExtra)
+}
+
+// Server-side sort request and response controls, RFC 2891.
+const (
+	controlTypeSortRequest  = "1.2.840.113556.1.4.473"
+	controlTypeSortResponse = "1.2.840.113556.1.4.474"
+)
+
+// newSortControl asks the server to return entries ordered by attribute. It
+// is not marked critical, so servers without support still answer, just
+// unsorted.
+func newSortControl(attribute string) ldap.Control {
+	keys := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Sort Key List")
+	key := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Sort Key")
+	key.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, attribute, "Attribute Type"))
+	keys.AppendChild(key)
+	return ldap.NewControlString(controlTypeSortRequest, false, string(keys.Bytes()))
+}
+
+// serverSorted reports whether the server says it sorted sr as asked.
+func serverSorted(sr *ldap.SearchResult) bool {
+	control, ok := ldap.FindControl(sr.Controls, controlTypeSortResponse).(*ldap.ControlString)
+	if !ok {
+		return false
+	}
+	value := ber.DecodePacket([]byte(control.ControlValue))
+	if value == nil || len(value.Children) == 0 {
+		return false
+	}
+	result, ok := value.Children[0].Value.(int64)
+	return ok && result == ldap.LDAPResultSuccess
+}
+
+// countGroup returns the number of members of group without fetching any
+// of their attributes. Without them, members that listGroup would skip are
+// still counted.
+func countGroup(l *conn, config AuthkeysConfig, group string) (int, error) {
+	sr, err := l.Search(ldap.NewSearchRequest(
+		config.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, true,
+		groupFilter(config, group),
+		[]string{"1.1"}, // RFC 4511: request no attributes
+		nil,
+	))
+	if err != nil {
+		return 0, err
+	}
+	return len(sr.Entries), nil
+}
+
+// listGroup returns the members of group.
+func listGroup(l *conn, config AuthkeysConfig, group string, options listOptions) ([]User, error) {
+	uidAttribute := attributeName(config, "Uid")
+	memberOfAttribute := attributeName(config, "MemberOf")
+	homeAttribute := attributeName(config, "HomeDirectory")
+	shellAttribute := attributeName(config, "Shell")
+
+	attributes := []string{uidAttribute, attributeName(config, "UidNumber"), attributeName(config, "GidNumber")}
+	if !options.Minimal && !config.UseTokenGroups {
+		attributes = append(attributes, memberOfAttribute)
+	}
+	attributes = append(attributes, homeAttribute, shellAttribute)
+	if config.EmailAttribute != "" {
+		attributes = append(attributes, config.EmailAttribute)
+	}
+	if config.DisplayNameAttribute != "" {
+		attributes = append(attributes, config.DisplayNameAttribute)
+	}
+	if config.PrimaryGroupAttribute != "" {
+		attributes = append(attributes, config.PrimaryGroupAttribute, "objectSid")
+	}
+	var controls []ldap.Control
+	if config.ServerSideSort {
+		controls = append(controls, newSortControl(uidAttribute))
+	}
+	searchRequest := ldap.NewSearchRequest(
+		config.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		groupFilter(config, group),
+		attributes, // attributes to retrieve
+		controls,
+	)
+
+	sr, err := l.Search(searchRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sr.Entries) == 0 {
+		return nil, fmt.Errorf("No entries returned from LDAP")
+	}
+	if config.ServerSideSort && !serverSorted(sr) {
+		log.Printf("Server did not sort the members of %s, sorting them here instead", group)
+		sort.SliceStable(sr.Entries, func(i, j int) bool {
+			return strings.ToLower(sr.Entries[i].GetAttributeValue(uidAttribute)) <
+				strings.ToLower(sr.Entries[j].GetAttributeValue(uidAttribute))
+		})
+	}
+
+	var tokenGroups map[string][]string
+	if config.UseTokenGroups {
+		userDNs := make([]string, len(sr.Entries))
+		for i, entry := range sr.Entries {
+			userDNs[i] = entry.DN
+		}
+		tokenGroups = tokenGroupDNs(l, config, userDNs)
+	}
+
+	cn := "cn="
+	gidCache := make(map[string]string)
+	seenUids := make(map[string]string)
+	var Users []User
+	for _, entry := range sr.Entries {
+		rawUid := entry.GetAttributeValue(uidAttribute)
+		if rawUid == "" && config.MissingUidPolicy == "dn" {
+			rawUid = uidFromDN(entry.DN)
+		}
+		if rawUid == "" {
+			log.Printf("Warning: skipping %s: no %s attribute", entry.DN, uidAttribute)
+			continue
+		}
+		rawMemberOf := entry.GetAttributeValues(memberOfAttribute)
+		resolved := false
+		if groups := tokenGroups[entry.DN]; len(groups) > 0 {
+			rawMemberOf = groups
+			resolved = true
+		}
+		// If it is a minimal ldap integration, or tokenGroups didn't
+		// resolve, read memberOf from each user's entry. The entry is
+		// re-read by DN, since it may have no uid to search by.
+		if (options.Minimal || config.UseTokenGroups) && !resolved {
+			userSearchRequest := ldap.NewSearchRequest(
+				entry.DN,
+				ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+				"(objectClass=*)",
+				[]string{memberOfAttribute},
+				nil,
+			)
+			userSr, err := l.Search(userSearchRequest)
+			if err != nil {
+				return nil, err
+			}
+			for _, userEntry := range userSr.Entries {
+				rawMemberOf = userEntry.GetAttributeValues(memberOfAttribute)
+			}
+		}
+
+		var memberOf []string
+		var username string
+		for i := range rawMemberOf {
+			switch config.GroupOutputFormat {
+			case "dn":
+				memberOf = append(memberOf, rawMemberOf[i])
+			case "gidNumber":
+				gid, err := groupGID(l, config, rawMemberOf[i], gidCache)
+				if err != nil {
+					log.Printf("Warning: leaving %s out of the groups of %s: %s", rawMemberOf[i], entry.DN, err)
+					continue
+				}
+				memberOf = append(memberOf, gid)
+			default:
+				cnLoc := strings.Index(rawMemberOf[i], cn)
+				termLoc := strings.Index(rawMemberOf[i], ",")
+				memberOf = append(memberOf, rawMemberOf[i][cnLoc+len(cn):termLoc])
+			}
+		}
+		// Some Idp do not support memberOf from a group listing so lets iterate over the user
+		if len(memberOf) == 0 && (config.GroupOutputFormat == "" || config.GroupOutputFormat == "cn") {
+			memberOf = append(memberOf, group)
+		}
+		// If the uid returns an email only use the prefix.
+		if strings.Contains(rawUid, "@") {
+			components := strings.Split(rawUid, "@")
+			username = components[0]
+		} else {
+			username = rawUid
+		}
+
+		homeDir := string(entry.GetAttributeValue(homeAttribute))
+		loginShell := string(entry.GetAttributeValue(shellAttribute))
+
+		user := User{
+			Uid:           username,
+			UidNumber:     selectID(config, entry, attributeName(config, "UidNumber")),
+			GidNumber:     selectID(config, entry, attributeName(config, "GidNumber")),
+			MemberOf:      memberOf,
+			HomeDirectory: homeDir,
+			Shell:         loginShell,
+		}
+		if config.EmailAttribute != "" {
+			user.Email = entry.GetAttributeValue(config.EmailAttribute)
+		}
+		if config.DisplayNameAttribute != "" {
+			user.Name = entry.GetAttributeValue(config.DisplayNameAttribute)
+		}
+		if options.WithDN {
+			user.DN = entry.DN
+		}
+		if user.GidNumber == "" && config.PrimaryGroupAttribute != "" {
+			gid, err := primaryGroupGID(l, config, entry, gidCache)
+			if err != nil {
+				log.Printf("Warning: unable to resolve the primary group of %s: %s", entry.DN, err)
+			}
+			user.GidNumber = gid
+		}
+		if config.HomeTemplate != "" && (user.HomeDirectory == "" || config.HomeTemplateOverride) {
+			user.HomeDirectory = expandHomeTemplate(config.HomeTemplate, user)
+		}
+		if config.RequireCompletePosixAccount {
+			if missing := missingPosixFields(user); len(missing) > 0 {
+				log.Printf("Warning: skipping %s: incomplete posixAccount, no %s", entry.DN, strings.Join(missing, ", "))
+				continue
+			}
+		}
+		if options.StrictIDs || config.MinUID != 0 || config.MaxUID != 0 {
+			if err := validateIDs(config, user); err != nil {
+				if options.StrictIDs {
+					return nil, err
+				}
+				log.Printf("Warning: skipping %s: %s", entry.DN, err)
+				continue
+			}
+		}
+		// A stale copy of an account elsewhere in the tree would otherwise
+		// be listed twice, with potentially conflicting attributes.
+		if firstDN, ok := seenUids[user.Uid]; ok {
+			log.Printf("Warning: skipping %s: uid %s was already listed from %s", entry.DN, user.Uid, firstDN)
+			continue
+		}
+		seenUids[user.Uid] = entry.DN
+		Users = append(Users, user)
+	}
+	if options.UidCollisions != "" {
+		if collisions := uidCollisions(Users); len(collisions) > 0 {
+			if options.UidCollisions == "fail" {
+				return nil, fmt.Errorf("Duplicate uidNumbers in %s: %s", group, strings.Join(collisions, "; "))
+			}
+			for _, collision := range collisions {
+				log.Printf("Warning: duplicate uidNumber in %s: %s", group, collision)
+			}
+		}
+	}
+	return Users, nil
+}
+
+// uidCollisions describes each uidNumber shared by more than one of users,
+// in numeric order. Users without a uidNumber are ignored.
+func uidCollisions(users []User) []string {
+	uidsByNumber := make(map[string][]string)
+	for _, user := range users {
+		if user.UidNumber != "" {
+			uidsByNumber[user.UidNumber] = append(uidsByNumber[user.UidNumber], user.Uid)
+		}
+	}
+	var numbers []string
+	for number, uids := range uidsByNumber {
+		if len(uids) > 1 {
+			numbers = append(numbers, number)
+		}
+	}
+	sort.Slice(numbers, func(i, j int) bool {
+		a, _ := strconv.Atoi(numbers[i])
+		b, _ := strconv.Atoi(numbers[j])
+		return a < b
+	})
+	var collisions []string
+	for _, number := range numbers {
+		collisions = append(collisions, fmt.Sprintf("%s is used by %s", number, strings.Join(uidsByNumber[number], ", ")))
+	}
+	return collisions
+}
+
+// groupGID returns the gidNumber of the group at groupDN, for
+// GroupOutputFormat "gidNumber". Results are kept in cache so each group is
+// only looked up once however many members share it.
+func groupGID(l *conn, config AuthkeysConfig, groupDN string, cache map[string]string) (string, error) {
+	gidAttribute := attributeName(config, "GidNumber")
+	gid, ok := cache[groupDN]
+	if !ok {
+		sr, err := l.Search(ldap.NewSearchRequest(
+			groupDN,
+			ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+			"(objectClass=*)",
+			[]string{gidAttribute},
+			nil,
+		))
+		if err != nil {
+			return "", err
+		}
+		if len(sr.Entries) == 1 {
+			gid = sr.Entries[0].GetAttributeValue(gidAttribute)
+		}
+		cache[groupDN] = gid
+	}
+	if gid == "" {
+		return "", fmt.Errorf("group has no %s", gidAttribute)
+	}
+	return gid, nil
 }
 
-type User struct {
-	Uid           string   `json:"id"`
-	UidNumber     string   `json:"uid"`
-	GidNumber     string   `json:"gid"`
-	MemberOf      []string `json:"groups"`
-	HomeDirectory string   `json:"home"`
-	Shell         string   `json:"shell"`
+// primaryGroupGID resolves the gidNumber of a user's primary group for
+// users with no gidNumber of their own. PrimaryGroupAttribute normally holds
+// the DN of the primary group. As Active Directory's primaryGroupID it holds
+// the group's RID instead, and the group's SID is the user's objectSid with
+// its final sub-authority replaced by that RID.
+func primaryGroupGID(l *conn, config AuthkeysConfig, entry *ldap.Entry, cache map[string]string) (string, error) {
+	value := entry.GetAttributeValue(config.PrimaryGroupAttribute)
+	if value == "" {
+		return "", fmt.Errorf("no %s attribute", config.PrimaryGroupAttribute)
+	}
+	if !strings.EqualFold(config.PrimaryGroupAttribute, "primaryGroupID") {
+		return groupGID(l, config, value, cache)
+	}
+
+	rid, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s %q", config.PrimaryGroupAttribute, value)
+	}
+	userSid := entry.GetRawAttributeValue("objectSid")
+	// revision, sub-authority count, 6-byte authority, then at least one
+	// little-endian 32-bit sub-authority
+	if len(userSid) < 12 {
+		return "", fmt.Errorf("no usable objectSid")
+	}
+	groupSid := append([]byte(nil), userSid...)
+	binary.LittleEndian.PutUint32(groupSid[len(groupSid)-4:], uint32(rid))
+	filter := fmt.Sprintf("(objectSid=%s)", escapeBinary(groupSid))
+
+	gidAttribute := attributeName(config, "GidNumber")
+	gid, ok := cache[filter]
+	if !ok {
+		sr, err := l.Search(ldap.NewSearchRequest(
+			config.BaseDN,
+			ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+			filter,
+			[]string{gidAttribute},
+			nil,
+		))
+		if err != nil {
+			return "", err
+		}
+		if len(sr.Entries) == 1 {
+			gid = sr.Entries[0].GetAttributeValue(gidAttribute)
+		}
+		cache[filter] = gid
+	}
+	if gid == "" {
+		return "", fmt.Errorf("primary group has no %s", gidAttribute)
+	}
+	return gid, nil
 }
 
-func NewConfig(fname string) AuthkeysConfig {
-	data, err := ioutil.ReadFile(fname)
+// groupKeys returns a single authorized_keys stream for every member of
+// group, each member's keys preceded by an "# owner:" comment. Keys shared
+// by several members are only emitted for the first of them, and members
+// whose keys can't be looked up are logged and left out.
+func groupKeys(l *conn, config AuthkeysConfig, group string) ([]string, error) {
+	users, err := listGroup(l, config, group, listOptions{})
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	config := AuthkeysConfig{}
-	err = json.Unmarshal(data, &config)
+	seen := make(map[string]bool)
+	var lines []string
+	for _, user := range users {
+		keys, err := lookupKeys(l, config, user.Uid, lookupOptions{})
+		if errors.Is(err, errNoKeys) {
+			continue
+		}
+		if err != nil {
+			log.Printf("Warning: skipping keys for %s: %s", user.Uid, err)
+			continue
+		}
+		var fresh []string
+		for _, key := range keys {
+			if !seen[key] {
+				seen[key] = true
+				fresh = append(fresh, key)
+			}
+		}
+		if len(fresh) > 0 {
+			lines = append(lines, "# owner: "+user.Uid)
+			lines = append(lines, fresh...)
+		}
+	}
+	return lines, nil
+}
+
+// UserKeys is one user's entry in the -users output.
+type UserKeys struct {
+	Keys  []string `json:"keys"`
+	Error string   `json:"error,omitempty"`
+}
+
+// lookupUsers looks up the keys of each of usernames over l. A failure for
+// one user is recorded against them rather than ending the batch.
+func lookupUsers(l *conn, config AuthkeysConfig, usernames []string) map[string]UserKeys {
+	results := make(map[string]UserKeys)
+	for _, username := range usernames {
+		keys, err := lookupKeys(l, config, username, lookupOptions{})
+		if errors.Is(err, errNoKeys) {
+			err = nil
+		}
+		if err != nil {
+			log.Printf("Unable to look up %s: %s", username, err)
+			results[username] = UserKeys{Keys: []string{}, Error: err.Error()}
+			continue
+		}
+		if keys == nil {
+			keys = []string{}
+		}
+		results[username] = UserKeys{Keys: keys}
+	}
+	return results
+}
+
+// parseUsernames splits the -users list on commas, or with "-" reads it
+// from stdin, one or more usernames to a line.
+func parseUsernames(list string) ([]string, error) {
+	var usernames []string
+	if list == "-" {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			usernames = append(usernames, strings.Fields(scanner.Text())...)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("Unable to read usernames from stdin: %s", err)
+		}
+		return usernames, nil
+	}
+	for _, username := range strings.Split(list, ",") {
+		if username = strings.TrimSpace(username); username != "" {
+			usernames = append(usernames, username)
+		}
+	}
+	return usernames, nil
+}
+
+// allowedSigners renders keys as ssh-keygen allowed_signers lines for
+// principal, restricted to AllowedSignersNamespaces if set. authorized_keys
+// options only make sense for logins, so they are dropped.
+func allowedSigners(config AuthkeysConfig, principal string, keys []string) []string {
+	if principal == "" || strings.ContainsAny(principal, " \t,\"") {
+		log.Printf("Warning: skipping allowed signers for %q: not usable as a principal", principal)
+		return nil
+	}
+	prefix := principal + " "
+	if len(config.AllowedSignersNamespaces) > 0 {
+		prefix += fmt.Sprintf("namespaces=%q ", strings.Join(config.AllowedSignersNamespaces, ","))
+	}
+	var lines []string
+	for _, key := range keys {
+		if strings.HasPrefix(key, "#") {
+			continue
+		}
+		parsed, err := parseKey(key)
+		if err != nil {
+			log.Printf("Warning: skipping a key of %s: %s", principal, err)
+			continue
+		}
+		line := prefix + parsed.Type + " " + base64.StdEncoding.EncodeToString(parsed.Blob)
+		if parsed.Comment != "" {
+			line += " " + parsed.Comment
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// signerPrincipal returns the allowed_signers principal for uid: the uid
+// itself, or with AllowedSignersPrincipal "email" the user's EmailAttribute.
+func signerPrincipal(l *conn, config AuthkeysConfig, uid string) (string, error) {
+	if config.AllowedSignersPrincipal != "email" {
+		return uid, nil
+	}
+	entry, err := findUser(l, config, config.BaseDN, uid+config.UserPostfix, []string{config.EmailAttribute})
 	if err != nil {
-		panic(err)
+		return "", err
 	}
-	return config
+	email := entry.GetAttributeValue(config.EmailAttribute)
+	if email == "" {
+		return "", fmt.Errorf("%s has no %s", uid, config.EmailAttribute)
+	}
+	return email, nil
 }
 
-func main() {
-	var config AuthkeysConfig
-	var configfile string
-	var attributes []string
+// groupAllowedSigners returns allowed_signers lines for every member of
+// group. Members whose keys can't be looked up are logged and left out.
+func groupAllowedSigners(l *conn, config AuthkeysConfig, group string) ([]string, error) {
+	users, err := listGroup(l, config, group, listOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, user := range users {
+		keys, err := lookupKeys(l, config, user.Uid, lookupOptions{})
+		if errors.Is(err, errNoKeys) {
+			continue
+		}
+		if err != nil {
+			log.Printf("Warning: skipping keys for %s: %s", user.Uid, err)
+			continue
+		}
+		principal := user.Uid
+		if config.AllowedSignersPrincipal == "email" {
+			principal = user.Email
+		}
+		lines = append(lines, allowedSigners(config, principal, keys)...)
+	}
+	return lines, nil
+}
 
-	// Get configuration
-	if os.Getenv("AUTHKEYS_CONFIG") == "" {
-		configfile = "/etc/authkeys.json"
+// watchCycle connects and looks up each of the CanaryUsers once, logging
+// the outcome and latency of each lookup. Once stop is closed no further
+// lookups are started.
+func watchCycle(config AuthkeysConfig, stop <-chan struct{}) {
+	cycleStart := time.Now()
+	failures := 0
+	l, err := connect(config)
+	if err != nil {
+		failures = len(config.CanaryUsers)
+		log.Printf("watch: connect failed after %s: %s", time.Since(cycleStart), err)
 	} else {
-		configfile = os.Getenv("AUTHKEYS_CONFIG")
+		defer l.Close()
+		for _, canary := range config.CanaryUsers {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			start := time.Now()
+			keys, err := lookupKeys(l, config, canary, lookupOptions{})
+			if errors.Is(err, errNoKeys) {
+				err = nil
+			}
+			if err != nil {
+				failures++
+				log.Printf("watch: user=%s status=fail duration=%s error=%q", canary, time.Since(start), err)
+				continue
+			}
+			log.Printf("watch: user=%s status=ok duration=%s keys=%d", canary, time.Since(start), len(keys))
+		}
 	}
-	if _, err := os.Stat(configfile); err == nil {
-		config = NewConfig(configfile)
+	log.Printf("watch: cycle complete users=%d failures=%d duration=%s",
+		len(config.CanaryUsers), failures, time.Since(cycleStart))
+}
+
+// watch runs a watchCycle every interval so authkeys can be used as a
+// black-box prober for the directory. On SIGHUP it re-reads the
+// configuration with reload, keeping the current one if that fails; each
+// cycle connects afresh, so the new configuration takes full effect from
+// the next cycle. On SIGINT or SIGTERM it stops starting new lookups, gives
+// the running cycle up to ShutdownTimeoutSeconds to finish and close its
+// connection, and returns.
+func watch(config AuthkeysConfig, interval time.Duration, reload func() (AuthkeysConfig, error)) {
+	if len(config.CanaryUsers) == 0 {
+		log.Fatalf("Watch mode requires at least one entry in CanaryUsers")
 	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	stop := make(chan struct{})
 
-	groupPtr := flag.String("group", "", "List members of this LDAP group")
-	minPtr := flag.String("min", "", "Use minimal attributes. (For LDAP that does not support memberOf)")
-	flag.Parse()
-	listUsers := false
-	username := ""
-	if *groupPtr != "" {
-		listUsers = true
-	} else if len(os.Args) != 2 {
-		log.Fatalf("Not enough parameters specified (or too many): just need LDAP username.")
-	} else {
-		username = os.Args[1]
-		username += config.UserPostfix
+	reloadConfig := func() {
+		newConfig, err := reload()
+		if err == nil && len(newConfig.CanaryUsers) == 0 {
+			err = fmt.Errorf("Watch mode requires at least one entry in CanaryUsers")
+		}
+		if err != nil {
+			log.Printf("watch: keeping current configuration: %s", err)
+			return
+		}
+		config = newConfig
+		log.Printf("watch: configuration reloaded, taking effect from the next cycle")
 	}
 
-	if *minPtr != "" {
-		attributes = []string{"uid", "uidNumber", "gidNumber", "homeDirectory", "loginShell"}
-	} else {
-		attributes = []string{"uid", "uidNumber", "gidNumber", "memberOf", "homeDirectory", "loginShell"}
+	for {
+		cycleStart := time.Now()
+		cycleConfig := config
+		done := make(chan struct{})
+		go func() {
+			watchCycle(cycleConfig, stop)
+			close(done)
+		}()
+
+	running:
+		for {
+			select {
+			case <-done:
+				break running
+			case sig := <-signals:
+				if sig == syscall.SIGHUP {
+					reloadConfig()
+					continue
+				}
+				shutdownTimeout := 10 * time.Second
+				if config.ShutdownTimeoutSeconds != 0 {
+					shutdownTimeout = time.Duration(config.ShutdownTimeoutSeconds) * time.Second
+				}
+				log.Printf("watch: received %s, waiting up to %s for the current cycle", sig, shutdownTimeout)
+				close(stop)
+				select {
+				case <-done:
+				case <-time.After(shutdownTimeout):
+					log.Printf("watch: cycle still running after %s, exiting anyway", shutdownTimeout)
+				}
+				return
+			}
+		}
+
+		next := time.After(interval - time.Since(cycleStart)%interval)
+	idle:
+		for {
+			select {
+			case <-next:
+				break idle
+			case sig := <-signals:
+				if sig == syscall.SIGHUP {
+					reloadConfig()
+					continue
+				}
+				log.Printf("watch: received %s, exiting", sig)
+				return
+			}
+		}
 	}
-	// Begin initial LDAP TCP connection. The LDAP library does have a Dial
-	// function that does most of what we need -- but its default timeout is 60
-	// seconds, which can be annoying if we're testing something in, say, Vagrant
-	var conntimeout time.Duration
-	if config.DialTimeout != 0 {
-		conntimeout = time.Duration(config.DialTimeout) * time.Second
-	} else {
-		conntimeout = time.Duration(5) * time.Second
+}
+
+// selfTest performs a full lookup of SelfTestUsername and fails unless at
+// least SelfTestExpectedKeyCount keys come back.
+func selfTest(config AuthkeysConfig) error {
+	if config.SelfTestUsername == "" {
+		return fmt.Errorf("Self test failed: SelfTestUsername is not configured")
 	}
-	server, err := net.DialTimeout("tcp",
-		fmt.Sprintf("%s:%d", config.LDAPServer, config.LDAPPort),
-		conntimeout)
+	l, err := connect(config)
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("Self test failed: unable to connect: %w", err)
 	}
-	l := ldap.NewConn(server, false)
-	l.Start()
 	defer l.Close()
+	keys, err := lookupKeys(l, config, config.SelfTestUsername, lookupOptions{})
+	if errors.Is(err, errNoKeys) && config.SelfTestExpectedKeyCount == 0 {
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("Self test failed: unable to look up %s: %w", config.SelfTestUsername, err)
+	}
+	if len(keys) < config.SelfTestExpectedKeyCount {
+		return fmt.Errorf("Self test failed: %s has %d keys, expected at least %d",
+			config.SelfTestUsername, len(keys), config.SelfTestExpectedKeyCount)
+	}
+	fmt.Printf("Self test passed: %s has %d keys\n", config.SelfTestUsername, len(keys))
+	return nil
+}
 
-	// Need a place to store TLS configuration
-	tlsConfig := &tls.Config{
-		InsecureSkipVerify: false,
-		ServerName:         config.LDAPServer,
+// annotateProvenance puts a comment before each key saying which server it
+// came from and when, for auditors; sshd ignores the comments.
+func annotateProvenance(l *conn, keys []string) []string {
+	host := l.host
+	if l.referral != nil {
+		host = l.referral.host
+	}
+	comment := fmt.Sprintf("# src=%s ts=%s", host, time.Now().UTC().Format(time.RFC3339))
+	var annotated []string
+	for _, key := range keys {
+		annotated = append(annotated, comment, key)
 	}
+	return annotated
+}
 
-	// Configure additional trust roots if necessary
-	if config.RootCAFile != "" {
-		rootCerts := x509.NewCertPool()
-		rootCAFile, err := ioutil.ReadFile(config.RootCAFile)
+// wrapOutput puts OutputPrefix and OutputSuffix, when set, around lines.
+func wrapOutput(config AuthkeysConfig, lines []string) []string {
+	if config.OutputPrefix != "" {
+		lines = append([]string{config.OutputPrefix}, lines...)
+	}
+	if config.OutputSuffix != "" {
+		lines = append(lines, config.OutputSuffix)
+	}
+	return lines
+}
+
+// writeLinesFile atomically replaces path with lines, readable only by its
+// owner, by writing a temporary file beside it and renaming it into place.
+func writeLinesFile(path string, lines []string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".authkeys-")
+	if err != nil {
+		return fmt.Errorf("Unable to write %s: %s", path, err)
+	}
+	defer os.Remove(tmp.Name())
+	var buf bytes.Buffer
+	for _, line := range lines {
+		buf.WriteString(line + "\n")
+	}
+	err = tmp.Chmod(0600)
+	if err == nil {
+		_, err = tmp.Write(buf.Bytes())
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to write %s: %s", path, err)
+	}
+	return nil
+}
+
+// exportUsers renders a group listing in format: "json" for a single JSON
+// array, or "passwd" or "newusers" for one name:password:uid:gid:gecos:home:shell
+// line per user, with any display name as the gecos. passwd lines have an
+// "x" password and leave out users without a uidNumber or gidNumber;
+// newusers lines leave the password empty so the accounts stay locked, and
+// the uid and gid empty for newusers to allocate.
+func exportUsers(users []User, format string) ([]string, error) {
+	if format == "json" {
+		out, err := json.Marshal(users)
 		if err != nil {
-			log.Fatalf("Unable to read RootCAFile: %s", err)
+			return nil, err
 		}
-		if !rootCerts.AppendCertsFromPEM(rootCAFile) {
-			log.Fatalf("Unable to append to CertPool from RootCAFile")
+		return []string{string(out)}, nil
+	}
+	var lines []string
+	for _, user := range users {
+		fields := []string{user.Uid, "", user.UidNumber, user.GidNumber, user.Name, user.HomeDirectory, user.Shell}
+		if format == "passwd" {
+			if user.UidNumber == "" || user.GidNumber == "" {
+				log.Printf("Warning: leaving %s out of passwd output: no uidNumber or gidNumber", user.Uid)
+				continue
+			}
+			fields[1] = "x"
 		}
-		tlsConfig.RootCAs = rootCerts
+		if strings.ContainsAny(strings.Join(fields, ""), ":\n") {
+			log.Printf("Warning: leaving %s out of %s output: an attribute contains ':' or a newline", user.Uid, format)
+			continue
+		}
+		lines = append(lines, strings.Join(fields, ":"))
 	}
+	return lines, nil
+}
 
-	// TLS our connection up
-	err = l.StartTLS(tlsConfig)
-	if err != nil {
-		log.Fatalf("Unable to start TLS connection: %s", err)
+// exitCode picks the exit status for err, so that scripts can tell a missing
+// user from an unreachable directory without parsing the log.
+func exitCode(err error) int {
+	switch {
+	case ldap.IsErrorWithCode(err, ldap.LDAPResultInsufficientAccessRights):
+		return exitInsufficientAccess
+	case errors.Is(err, errUserNotFound):
+		return exitUserNotFound
+	case errors.Is(err, errMultipleUsers):
+		return exitMultipleUsers
+	case errors.Is(err, errNoKeys):
+		return exitNoKeys
+	case errors.Is(err, errConnect):
+		return exitConnect
+	case errors.Is(err, errBind):
+		return exitBind
 	}
+	return 1
+}
 
-	// If we have a BindDN go ahead and bind before searching
-	if config.BindDN != "" && config.BindPW != "" {
-		err = l.Bind(config.BindDN, config.BindPW)
-		if err != nil {
-			log.Fatalf("Unable to bind: %s", err)
+// fatal logs err and exits with the status exitCode picks for it.
+func fatal(err error) {
+	log.Print(err)
+	exit(exitCode(err))
+}
+
+// openConn is the connection main has open, if any.
+var openConn *conn
+
+// exit closes openConn and exits with code. os.Exit skips deferred calls, so
+// the connection would otherwise be dropped without an unbind.
+func exit(code int) {
+	if openConn != nil {
+		openConn.Close()
+	}
+	os.Exit(code)
+}
+
+// correlationID returns the identifier tagged onto every log line of this
+// invocation: AUTHKEYS_CORRELATION_ID if the caller supplied one, stripped
+// of anything that could break up a log line, or a random one otherwise.
+func correlationID() string {
+	id := strings.Map(func(r rune) rune {
+		if r <= ' ' || r == 0x7f {
+			return -1
 		}
+		return r
+	}, os.Getenv("AUTHKEYS_CORRELATION_ID"))
+	if id != "" {
+		return id
 	}
+	rng := rand.New(rand.NewSource(time.Now().UnixNano() ^ int64(os.Getpid())))
+	return fmt.Sprintf("%016x", rng.Uint64())
+}
 
-	var searchRequest *ldap.SearchRequest
-	if listUsers {
-		searchRequest = ldap.NewSearchRequest(
-			config.BaseDN,
-			ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
-			fmt.Sprintf("(&(objectClass=inetOrgPerson)(memberOf=cn=%s,ou=%s,%s))", *groupPtr, config.GroupObject, config.BaseDN),
-			attributes, // attributes to retrieve
-			nil,
-		)
+func main() {
+	var configfile string
+
+	log.SetFlags(log.LstdFlags | log.Lmsgprefix)
+	log.SetPrefix("cid=" + correlationID() + " ")
+
+	groupPtr := flag.String("group", "", "List members of this LDAP group")
+	minPtr := flag.String("min", "", "Use minimal attributes. (For LDAP that does not support memberOf)")
+	watchPtr := flag.Duration("watch", 0, "Repeat lookups of CanaryUsers at this interval and log the results")
+	checkConfigPtr := flag.Bool("check-config", false, "Validate the configuration, treating unknown keys as errors, and exit")
+	tracePtr := flag.Bool("trace", false, "Log how long each step of talking to LDAP takes")
+	selfTestPtr := flag.Bool("selftest", false, "Look up SelfTestUsername and check it has enough keys")
+	withDNPtr := flag.Bool("with-dn", false, "Include each user's DN in group listings")
+	strictIDsPtr := flag.Bool("strict-ids", false, "Fail group listings on any invalid uidNumber or gidNumber")
+	uidCollisionsPtr := flag.String("detect-uid-collisions", "", "With -group, \"warn\" about or \"fail\" on members sharing a uidNumber")
+	exportFormatPtr := flag.String("export-format", "json", "With -group, print members as \"json\", \"passwd\" or \"newusers\" lines")
+	countPtr := flag.Bool("count", false, "With -group, print only the number of entries the group search matches, including any the listing would skip")
+	explainPtr := flag.Bool("explain", false, "Describe how the lookup of username went instead of printing keys")
+	allowedSignersPtr := flag.Bool("allowed-signers", false, "Print keys in ssh-keygen allowed_signers format, for a username or with -group-keys")
+	breakGlassPtr := flag.Bool("break-glass", false, "Serve keys despite UserFilterExtra, key expiry and access schedules; needs AUTHKEYS_BREAK_GLASS")
+	diffPtr := flag.Bool("diff", false, "With a username and an authorized_keys file, report keys only in one or the other")
+	jsonDetailedPtr := flag.Bool("json-detailed", false, "Print a JSON description of each key instead of the keys")
+	outPtr := flag.String("out", "", "Write the keys, or the -group, -group-keys, -count or -users output, to this file instead of stdout")
+	showSuppressedPtr := flag.Bool("show-suppressed", false, "Print expired and over-long keys as comments instead of dropping them")
+	groupKeysPtr := flag.String("group-keys", "", "Print the keys of every member of this LDAP group as one authorized_keys file")
+	usersPtr := flag.String("users", "", "Print the keys of these comma-separated usernames, or \"-\" to read them from stdin, as a JSON object")
+	modePtr := flag.String("mode", "keys", "Print a username's \"keys\" for AuthorizedKeysCommand or \"principals\" for AuthorizedPrincipalsCommand")
+	flag.Parse()
+	traceEnabled = *tracePtr
+	explainEnabled = *explainPtr
+
+	// Get configuration
+	if os.Getenv("AUTHKEYS_CONFIG") == "" {
+		configfile = "/etc/authkeys.json"
 	} else {
-		// Set up an LDAP search and actually do the search
-		searchRequest = ldap.NewSearchRequest(
-			config.BaseDN,
-			ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
-			fmt.Sprintf("(%s=%s)", config.UserAttribute, username),
-			[]string{config.KeyAttribute},
-			nil,
-		)
+		configfile = os.Getenv("AUTHKEYS_CONFIG")
+	}
+	config, err := loadConfig(configfile, *checkConfigPtr)
+	if err != nil {
+		log.Printf("Unable to load configuration: %s", err)
+		os.Exit(exitConfig)
+	}
+	if *checkConfigPtr {
+		fmt.Printf("Configuration OK\n")
+		return
+	}
+	if *selfTestPtr {
+		if err := selfTest(config); err != nil {
+			fatal(err)
+		}
+		return
+	}
+	if *watchPtr > 0 {
+		watch(config, *watchPtr, func() (AuthkeysConfig, error) {
+			return loadConfig(configfile, false)
+		})
+		return
+	}
+	if *countPtr && *groupPtr == "" {
+		log.Fatalf("-count can only be used with -group")
+	}
+	if *uidCollisionsPtr != "" && *uidCollisionsPtr != "warn" && *uidCollisionsPtr != "fail" {
+		log.Fatalf("-detect-uid-collisions must be \"warn\" or \"fail\"")
+	}
+	if *exportFormatPtr != "json" && *exportFormatPtr != "passwd" && *exportFormatPtr != "newusers" {
+		log.Fatalf("-export-format must be \"json\", \"passwd\" or \"newusers\"")
+	}
+	switch *modePtr {
+	case "keys":
+	case "principals":
+		if config.PrincipalAttribute == "" {
+			log.Fatalf("-mode principals needs PrincipalAttribute")
+		}
+		if *groupPtr != "" || *groupKeysPtr != "" || *usersPtr != "" || *diffPtr || *allowedSignersPtr || *jsonDetailedPtr {
+			log.Fatalf("-mode principals only applies to printing a single username")
+		}
+	default:
+		log.Fatalf("-mode must be \"keys\" or \"principals\"")
+	}
+	// The diagnosis goes to stdout, where it would mix into the output of
+	// the other modes, or take the place of what they were asked to do.
+	if *explainPtr && (*groupPtr != "" || *groupKeysPtr != "" || *usersPtr != "" || *outPtr != "" ||
+		*diffPtr || *allowedSignersPtr || *jsonDetailedPtr) {
+		log.Fatalf("-explain only applies to looking up a single username")
+	}
+	listUsers := false
+	username := ""
+	var diffLines []string
+	var usernames []string
+	if *groupPtr != "" || *groupKeysPtr != "" {
+		listUsers = true
+	} else if *usersPtr != "" {
+		listUsers = true
+		usernames, err = parseUsernames(*usersPtr)
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+		if len(usernames) == 0 {
+			log.Fatalf("-users needs at least one username")
+		}
+	} else if *diffPtr {
+		if flag.NArg() != 2 {
+			log.Fatalf("-diff needs a username and an authorized_keys file")
+		}
+		username = flag.Arg(0)
+		data, err := ioutil.ReadFile(flag.Arg(1))
+		if err != nil {
+			log.Fatalf("Unable to read %s: %s", flag.Arg(1), err)
+		}
+		diffLines = strings.Split(string(data), "\n")
+	} else if flag.NArg() != 1 {
+		log.Fatalf("Not enough parameters specified (or too many): just need LDAP username.")
+	} else {
+		username = flag.Arg(0)
 	}
 
-	sr, err := l.Search(searchRequest)
+	// So that -out paths and allowed_signers principals get the bare name.
+	username = stripDomainPrefix(config, username)
+
+	if *breakGlassPtr {
+		reason := os.Getenv("AUTHKEYS_BREAK_GLASS")
+		if reason == "" {
+			log.Fatalf("-break-glass needs AUTHKEYS_BREAK_GLASS set to the reason, such as an incident number")
+		}
+		if listUsers {
+			log.Fatalf("-break-glass only applies to looking up a single user")
+		}
+		// Logged before anything else can fail, so every attempt is on record.
+		log.Printf("AUTHKEYS_BREAK_GLASS user=%q reason=%q: ignoring UserFilterExtra, KeyValidityAttribute and AccessScheduleAttribute",
+			username, reason)
+		config.UserFilterExtra = ""
+		config.KeyValidityAttribute = ""
+		config.AccessScheduleAttribute = ""
+	}
+
+	// Single-user lookups have someone (or sshd) waiting on them, so they
+	// skip the jitter unless told otherwise; -out is provisioning.
+	if config.StartupJitterMs > 0 && (listUsers || *outPtr != "" || config.StartupJitterInteractive) {
+		startupJitter(config)
+	}
+	l, err := connect(config)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
+	defer l.Close()
+	openConn = l
 
-	if len(sr.Entries) == 0 {
-		log.Fatalf("No entries returned from LDAP")
-	} else if !listUsers && (len(sr.Entries) > 1) {
-		log.Fatalf("Too many entries returned from LDAP")
+	if !listUsers && *explainPtr {
+		fmt.Printf("Looking up %s:\n", username)
+		keys, err := lookupKeys(l, config, username, lookupOptions{Principals: *modePtr == "principals"})
+		if err != nil {
+			fmt.Printf("Result: no %s: %s\n", *modePtr, err)
+			exit(exitCode(err))
+		}
+		fmt.Printf("Result: %d %s would be served\n", len(keys), *modePtr)
+		return
 	}
 
-	var attribute string
-	cn := "cn="
-	if listUsers {
-		var Users []User
-		for _, entry := range sr.Entries {
-			rawMemberOf := entry.GetAttributeValues("memberOf")
-			// If it is a minimal ldap integration search for memberOf for each user.
-			if *minPtr != "" {
-				userSearchRequest := ldap.NewSearchRequest(
-					config.BaseDN,
-					ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
-					fmt.Sprintf("(%s=%s)", config.UserAttribute, entry.GetAttributeValues(config.UserAttribute)[0]),
-					[]string{"memberOf"},
-					nil,
-				)
-				userSr, err := l.Search(userSearchRequest)
-				if err != nil {
-					log.Fatal(err)
-				}
-				for _, userEntry := range userSr.Entries {
-					rawMemberOf = userEntry.GetAttributeValues("memberOf")
-				}
+	if !listUsers {
+		keys, err := lookupKeys(l, config, username, lookupOptions{
+			ShowSuppressed: *showSuppressedPtr,
+			Principals:     *modePtr == "principals",
+		})
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInsufficientAccessRights) {
+			// Otherwise indistinguishable from a user with no keys.
+			log.Printf("Insufficient access rights looking up %s; check that %q may read %s: %s",
+				username, config.BindDN, config.KeyAttribute, err)
+			exit(exitInsufficientAccess)
+		}
+		// A diff still reports the file's keys, and -out still empties the
+		// file so that removed keys don't linger.
+		noKeys := errors.Is(err, errNoKeys)
+		if err != nil && (!noKeys || (!*diffPtr && *outPtr == "")) {
+			fatal(err)
+		}
+		if *diffPtr {
+			diff := diffKeys(keys, diffLines)
+			report, err := json.Marshal(diff)
+			if err != nil {
+				fatal(err)
 			}
-
-			var memberOf []string
-			var username string
-			for group := range rawMemberOf {
-				cnLoc := strings.Index(rawMemberOf[group], cn)
-				termLoc := strings.Index(rawMemberOf[group], ",")
-				memberOf = append(memberOf, rawMemberOf[group][cnLoc+len(cn):termLoc])
+			fmt.Printf("%s\n", report)
+			if len(diff.OnlyInLDAP) > 0 || len(diff.OnlyInFile) > 0 {
+				exit(exitKeysDiffer)
 			}
-			// Some Idp do not support memberOf from a group listing so lets iterate over the user
-			if len(memberOf) == 0 {
-				memberOf = append(memberOf, *groupPtr)
+			return
+		}
+		if *allowedSignersPtr {
+			principal, err := signerPrincipal(l, config, username)
+			if err != nil {
+				fatal(err)
+			}
+			for _, line := range allowedSigners(config, principal, keys) {
+				fmt.Printf("%s\n", line)
+			}
+			return
+		}
+		if *jsonDetailedPtr {
+			details, err := json.Marshal(keyDetails(keys))
+			if err != nil {
+				fatal(err)
+			}
+			fmt.Printf("%s\n", details)
+			return
+		}
+		if config.AnnotateProvenance {
+			keys = annotateProvenance(l, keys)
+		}
+		keys = wrapOutput(config, keys)
+		if *outPtr != "" {
+			if strings.Contains(username, "/") {
+				fatal(fmt.Errorf("Refusing to use %q in an -out path", username))
+			}
+			if err := writeLinesFile(expandHomeTemplate(*outPtr, User{Uid: username}), keys); err != nil {
+				fatal(err)
 			}
-			// If the uid returns an email only use the prefix.
-			if strings.Contains(string(entry.GetAttributeValue("uid")), "@") {
-				email := string(entry.GetAttributeValue("uid"))
-				components := strings.Split(email, "@")
-				username = components[0]
-			} else {
-				username = string(entry.GetAttributeValue("uid"))
+			if noKeys {
+				fatal(err)
 			}
+			return
+		}
+		for _, key := range keys {
+			fmt.Printf("%s\n", key)
+		}
+		return
+	}
 
-			homeDir := string(entry.GetAttributeValue("homeDirectory"))
-			loginShell := string(entry.GetAttributeValue("loginShell"))
+	if *usersPtr != "" {
+		report, err := json.Marshal(lookupUsers(l, config, usernames))
+		if err != nil {
+			fatal(err)
+		}
+		if *outPtr != "" {
+			if err := writeLinesFile(*outPtr, []string{string(report)}); err != nil {
+				fatal(err)
+			}
+			return
+		}
+		fmt.Printf("%s\n", report)
+		return
+	}
 
-			Users = append(Users, User{
-				Uid:           username,
-				UidNumber:     string(entry.GetAttributeValue("uidNumber")),
-				GidNumber:     string(entry.GetAttributeValue("gidNumber")),
-				MemberOf:      memberOf,
-				HomeDirectory: homeDir,
-				Shell:         loginShell,
-			})
+	if *groupKeysPtr != "" {
+		render := groupKeys
+		if *allowedSignersPtr {
+			render = groupAllowedSigners
 		}
-		myUsers, err := json.Marshal(Users)
+		lines, err := render(l, config, *groupKeysPtr)
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
-		fmt.Printf("%s\n", myUsers)
-	} else {
-		attribute = config.KeyAttribute
-		for _, entry := range sr.Entries {
-			keys := entry.GetAttributeValues(attribute)
-			for _, key := range keys {
-				fmt.Printf("%s\n", key)
+		lines = wrapOutput(config, lines)
+		if *outPtr != "" {
+			if err := writeLinesFile(*outPtr, lines); err != nil {
+				fatal(err)
+			}
+			return
+		}
+		for _, line := range lines {
+			fmt.Printf("%s\n", line)
+		}
+		return
+	}
+
+	if *countPtr {
+		count, err := countGroup(l, config, *groupPtr)
+		if err != nil {
+			fatal(err)
+		}
+		if *outPtr != "" {
+			if err := writeLinesFile(*outPtr, []string{strconv.Itoa(count)}); err != nil {
+				fatal(err)
 			}
+			return
 		}
+		fmt.Printf("%d\n", count)
+		return
+	}
+
+	users, err := listGroup(l, config, *groupPtr, listOptions{
+		Minimal:       *minPtr != "",
+		WithDN:        *withDNPtr,
+		StrictIDs:     *strictIDsPtr,
+		UidCollisions: *uidCollisionsPtr,
+	})
+	if err != nil {
+		fatal(err)
+	}
+	lines, err := exportUsers(users, *exportFormatPtr)
+	if err != nil {
+		fatal(err)
+	}
+	if *outPtr != "" {
+		if err := writeLinesFile(*outPtr, lines); err != nil {
+			fatal(err)
+		}
+		return
+	}
+	for _, line := range lines {
+		fmt.Printf("%s\n", line)
 	}
-	// Get the keys & print 'em. This will only print keys for the first user
-	// returned from LDAP, but if you have multiple users with the same name maybe
-	// setting a different BaseDN may be useful.
 }
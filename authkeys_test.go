@@ -0,0 +1,1855 @@
+// authkeys - lookup a user's SSH keys as stored in LDAP
+// authkeys_test.go: tests for authkeys.go.
+//
+// Licensed under the BSD 3-clause license; see LICENSE for more information.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	cryptorand "crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"gopkg.in/asn1-ber.v1"
+	"gopkg.in/ldap.v2"
+)
+
+func TestRetryable(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"connection refused", fmt.Errorf("%w: %w", errConnect, refused), true},
+		{"connection reset", fmt.Errorf("%w: %w", errConnect, syscall.ECONNRESET), true},
+		{"timeout", fmt.Errorf("%w: %w", errConnect, os.ErrDeadlineExceeded), true},
+		{"temporary DNS failure", fmt.Errorf("%w: %w", errConnect, &net.DNSError{Err: "server misbehaving", IsTemporary: true}), true},
+		{"unknown host", fmt.Errorf("%w: %w", errConnect, &net.DNSError{Err: "no such host", IsNotFound: true}), true},
+		{"connection dropped", fmt.Errorf("%w: %w", errBind, ldap.NewError(ldap.ErrorNetwork, errors.New("ldap: response channel closed"))), true},
+		{"invalid credentials", fmt.Errorf("%w: %w", errBind, ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("bad password"))), false},
+		{"inappropriate authentication", fmt.Errorf("%w: %w", errBind, ldap.NewError(ldap.LDAPResultInappropriateAuthentication, errors.New("simple bind refused"))), false},
+		{"busy server", fmt.Errorf("%w: %w", errBind, ldap.NewError(ldap.LDAPResultBusy, errors.New("busy"))), true},
+		{"bad certificate", fmt.Errorf("%w: TLS handshake failed: %w", errConnect, x509.UnknownAuthorityError{}), true},
+		{"expiring certificate", fmt.Errorf("%w: TLS handshake failed: %w", errConnect, errors.New("Certificate from ldap1 expires soon")), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := retryable(test.err); got != test.want {
+				t.Errorf("retryable(%v) = %v, want %v", test.err, got, test.want)
+			}
+		})
+	}
+}
+
+func TestRetryableRefusedDial(t *testing.T) {
+	// Find a port nothing listens on.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	_, err = connectServer(AuthkeysConfig{}, LDAPServerConfig{Host: "127.0.0.1", Port: port}, dialTimeout(AuthkeysConfig{}))
+	if err == nil {
+		t.Fatal("connectServer succeeded with nothing listening")
+	}
+	if !retryable(err) {
+		t.Errorf("retryable(%v) = false, want true", err)
+	}
+}
+
+// fakeOp is one request received by a fakeLDAP.
+type fakeOp struct {
+	name       string // bind, starttls, search, compare or unbind
+	dn         string // bind name, search base or compared entry
+	filter     string
+	attributes []string
+	controls   []string // control OIDs
+	assertion  [2]string
+}
+
+// fakeLDAP is a minimal LDAP server on 127.0.0.1 speaking LDAPS or StartTLS
+// with a certificate of its own. By default every search is answered with
+// all of entries, and compares with whether members lists the value for the
+// entry.
+type fakeLDAP struct {
+	listener  net.Listener
+	tlsConfig *tls.Config
+	caFile    string
+	ldaps     bool
+
+	entries []*ldap.Entry
+	members map[string][]string
+	search  func(op fakeOp) []*ldap.Entry
+	// dropCompare has compares answered with a notice of disconnection.
+	dropCompare bool
+	// rejectBind has binds answered with invalidCredentials.
+	rejectBind bool
+
+	mu  sync.Mutex
+	ops []fakeOp
+}
+
+func newFakeLDAP(t testing.TB, ldaps bool) *fakeLDAP {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeLDAP{listener: listener, ldaps: ldaps}
+	f.expireIn(t, 24*time.Hour)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(c)
+		}
+	}()
+	return f
+}
+
+// expireIn gives f a new self-signed certificate, written to its caFile,
+// that expires after d.
+func (f *fakeLDAP) expireIn(t testing.TB, d time.Duration) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "authkeys test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(d),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(cryptorand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.caFile = caFile
+	f.tlsConfig = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+}
+
+func (f *fakeLDAP) certificate() *tls.Config {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.tlsConfig
+}
+
+// server returns an LDAPServers entry for f, with its own RootCAFile.
+func (f *fakeLDAP) server() LDAPServerConfig {
+	return LDAPServerConfig{
+		Host:       "127.0.0.1",
+		Port:       f.listener.Addr().(*net.TCPAddr).Port,
+		RootCAFile: f.caFile,
+	}
+}
+
+// config returns a configuration for connecting to f.
+func (f *fakeLDAP) config() AuthkeysConfig {
+	return AuthkeysConfig{
+		BaseDN:        "dc=example,dc=com",
+		KeyAttribute:  "sshPublicKey",
+		LDAPServer:    "127.0.0.1",
+		LDAPPort:      f.listener.Addr().(*net.TCPAddr).Port,
+		RootCAFile:    f.caFile,
+		UserAttribute: "uid",
+		UseLDAPS:      f.ldaps,
+	}
+}
+
+func (f *fakeLDAP) record(op fakeOp) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ops = append(f.ops, op)
+}
+
+// requests returns the requests received so far with the given name.
+func (f *fakeLDAP) requests(name string) []fakeOp {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var ops []fakeOp
+	for _, op := range f.ops {
+		if op.name == name {
+			ops = append(ops, op)
+		}
+	}
+	return ops
+}
+
+func (f *fakeLDAP) serve(c net.Conn) {
+	defer func() { c.Close() }()
+	if f.ldaps {
+		tlsConn := tls.Server(c, f.certificate())
+		if tlsConn.Handshake() != nil {
+			return
+		}
+		c = tlsConn
+	}
+	for {
+		message, err := readTLV(c)
+		if err != nil {
+			return
+		}
+		id, op, controls := splitMessage(message)
+		request := fakeOp{}
+		for _, control := range controls {
+			if oid, _, ok := nextTLV(control); ok {
+				request.controls = append(request.controls, string(oid))
+			}
+		}
+		switch op[0] & 0x1f {
+		case ldap.ApplicationBindRequest:
+			packet := decodeOp(op)
+			request.name = "bind"
+			request.dn = packet.Children[1].Value.(string)
+			f.record(request)
+			var code uint8 = ldap.LDAPResultSuccess
+			if f.rejectBind {
+				code = ldap.LDAPResultInvalidCredentials
+			}
+			f.reply(c, id, resultPacket(ldap.ApplicationBindResponse, code))
+		case ldap.ApplicationUnbindRequest:
+			request.name = "unbind"
+			f.record(request)
+			return
+		case ldap.ApplicationExtendedRequest:
+			request.name = "starttls"
+			f.record(request)
+			f.reply(c, id, resultPacket(ldap.ApplicationExtendedResponse, ldap.LDAPResultSuccess))
+			tlsConn := tls.Server(c, f.certificate())
+			if tlsConn.Handshake() != nil {
+				return
+			}
+			c = tlsConn
+		case ldap.ApplicationSearchRequest:
+			packet := decodeOp(op)
+			request.name = "search"
+			request.dn = packet.Children[0].Value.(string)
+			request.filter, _ = ldap.DecompileFilter(packet.Children[6])
+			for _, attribute := range packet.Children[7].Children {
+				request.attributes = append(request.attributes, attribute.Value.(string))
+			}
+			f.record(request)
+			entries := f.entries
+			if f.search != nil {
+				entries = f.search(request)
+			}
+			for _, entry := range entries {
+				f.reply(c, id, entryPacket(entry))
+			}
+			f.reply(c, id, resultPacket(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess))
+		case ldap.ApplicationCompareRequest:
+			// Like a strict server, this one wants the assertion value as a
+			// primitive octet string, and rejects ldap.v2's constructed one.
+			request.name = "compare"
+			packet, err := ber.DecodePacketErr(op)
+			if err != nil || len(packet.Children) != 2 || len(packet.Children[1].Children) != 2 ||
+				packet.Children[1].Children[1].TagType != ber.TypePrimitive {
+				f.record(request)
+				f.reply(c, id, resultPacket(ldap.ApplicationCompareResponse, ldap.LDAPResultProtocolError))
+				continue
+			}
+			request.dn = packet.Children[0].Value.(string)
+			ava := packet.Children[1].Children
+			request.assertion = [2]string{ava[0].Value.(string), ava[1].Value.(string)}
+			f.record(request)
+			if f.dropCompare {
+				notice := resultPacket(ldap.ApplicationExtendedResponse, ldap.LDAPResultUnavailable)
+				notice.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 10, "1.3.6.1.4.1.1466.20036", "Notice of Disconnection"))
+				c.Write(ldapMessage(0, notice).Bytes())
+				return
+			}
+			var code uint8 = ldap.LDAPResultCompareFalse
+			for _, group := range f.members[request.dn] {
+				if strings.EqualFold(group, request.assertion[1]) {
+					code = ldap.LDAPResultCompareTrue
+				}
+			}
+			f.reply(c, id, resultPacket(ldap.ApplicationCompareResponse, code))
+		default:
+			return
+		}
+	}
+}
+
+func (f *fakeLDAP) reply(c net.Conn, id int64, op *ber.Packet) {
+	c.Write(ldapMessage(id, op).Bytes())
+}
+
+// readTLV reads one BER element from r.
+func readTLV(r io.Reader) ([]byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	length := int(header[1])
+	if length&0x80 != 0 {
+		octets := make([]byte, length&0x7f)
+		if _, err := io.ReadFull(r, octets); err != nil {
+			return nil, err
+		}
+		header = append(header, octets...)
+		length = 0
+		for _, b := range octets {
+			length = length<<8 | int(b)
+		}
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return append(header, body...), nil
+}
+
+// tlvBody splits a BER element into its identifier and contents.
+func tlvBody(element []byte) (byte, []byte) {
+	header, length := 2, int(element[1])
+	if length&0x80 != 0 {
+		header += length & 0x7f
+		length = 0
+		for _, b := range element[2:header] {
+			length = length<<8 | int(b)
+		}
+	}
+	return element[0], element[header : header+length]
+}
+
+// nextTLV returns the contents of the first BER element of data, and the
+// elements after it.
+func nextTLV(data []byte) ([]byte, []byte, bool) {
+	if len(data) < 2 {
+		return nil, nil, false
+	}
+	element, err := readTLV(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, false
+	}
+	_, body := tlvBody(element)
+	return body, data[len(element):], true
+}
+
+// splitMessage takes apart an LDAPMessage into its ID, the operation
+// element, and the contents of each control.
+func splitMessage(message []byte) (int64, []byte, [][]byte) {
+	_, body := tlvBody(message)
+	idBytes, rest, _ := nextTLV(body)
+	var id int64
+	for _, b := range idBytes {
+		id = id<<8 | int64(b)
+	}
+	opElement, _ := readTLV(bytes.NewReader(rest))
+	rest = rest[len(opElement):]
+	var controls [][]byte
+	if controlList, _, ok := nextTLV(rest); ok {
+		for len(controlList) > 0 {
+			var control []byte
+			control, controlList, ok = nextTLV(controlList)
+			if !ok {
+				break
+			}
+			controls = append(controls, control)
+		}
+	}
+	return id, opElement, controls
+}
+
+func decodeOp(op []byte) *ber.Packet {
+	packet, err := ber.DecodePacketErr(op)
+	if err != nil {
+		panic(err)
+	}
+	return packet
+}
+
+func resultPacket(tag ber.Tag, code uint8) *ber.Packet {
+	packet := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "Result Code"))
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	return packet
+}
+
+func entryPacket(entry *ldap.Entry) *ber.Packet {
+	packet := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.DN, "DN"))
+	attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+	for _, attribute := range entry.Attributes {
+		element := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+		element.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, attribute.Name, "Type"))
+		values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+		for _, value := range attribute.Values {
+			values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "Value"))
+		}
+		element.AppendChild(values)
+		attributes.AppendChild(element)
+	}
+	packet.AppendChild(attributes)
+	return packet
+}
+
+// fakeEntry builds an entry with attributes given as name, value pairs, so
+// that their order is kept.
+func fakeEntry(dn string, pairs ...string) *ldap.Entry {
+	entry := &ldap.Entry{DN: dn}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		var attribute *ldap.EntryAttribute
+		for _, existing := range entry.Attributes {
+			if existing.Name == pairs[i] {
+				attribute = existing
+			}
+		}
+		if attribute == nil {
+			attribute = &ldap.EntryAttribute{Name: pairs[i]}
+			entry.Attributes = append(entry.Attributes, attribute)
+		}
+		attribute.Values = append(attribute.Values, pairs[i+1])
+	}
+	return entry
+}
+
+func TestInRequiredGroupCompare(t *testing.T) {
+	const userDN = "uid=jdoe,ou=people,dc=example,dc=com"
+	const groupDN = "cn=admins,ou=groups,dc=example,dc=com"
+	tests := []struct {
+		name        string
+		group       string
+		members     []string
+		dropCompare bool
+		want        bool
+	}{
+		{"member by DN", groupDN, []string{groupDN}, false, true},
+		{"member by name", "admins", []string{groupDN}, false, true},
+		{"not a member", "admins", []string{"cn=staff,ou=groups,dc=example,dc=com"}, false, false},
+		{"dropped compare", "admins", []string{groupDN}, true, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFakeLDAP(t, true)
+			f.members = map[string][]string{userDN: test.members}
+			f.dropCompare = test.dropCompare
+			config := f.config()
+			config.GroupObject = "groups"
+			config.RequiredGroup = test.group
+			config.RequiredGroupStyle = "compare"
+			if err := validateConfig(config); err != nil {
+				t.Fatal(err)
+			}
+			l, err := connect(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+
+			got, err := inRequiredGroup(l, config, fakeEntry(userDN), "jdoe")
+			if test.dropCompare {
+				if !ldap.IsErrorWithCode(err, ldap.ErrorNetwork) {
+					t.Errorf("inRequiredGroup = %v, %v after a dropped compare, want a network error", got, err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("inRequiredGroup = %v, want %v", got, test.want)
+			}
+			compares := f.requests("compare")
+			if len(compares) != 1 {
+				t.Fatalf("%d compares, want 1", len(compares))
+			}
+			if compares[0].dn != userDN || compares[0].assertion != [2]string{"memberOf", groupDN} {
+				t.Errorf("compared %s %v, want %s memberOf=%s", compares[0].dn, compares[0].assertion, userDN, groupDN)
+			}
+			if searches := len(f.requests("search")); searches != 0 {
+				t.Errorf("%d searches, want none", searches)
+			}
+		})
+	}
+}
+
+func TestCompareEncoding(t *testing.T) {
+	const userDN = "uid=jdoe,ou=people,dc=example,dc=com"
+	const groupDN = "cn=admins,ou=groups,dc=example,dc=com"
+	f := newFakeLDAP(t, true)
+	f.members = map[string][]string{userDN: {groupDN}}
+	f.entries = []*ldap.Entry{fakeEntry(userDN, "uid", "jdoe")}
+	l, err := connect(f.config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if _, err := l.Conn.Compare(userDN, "memberOf", groupDN); !ldap.IsErrorWithCode(err, ldap.LDAPResultProtocolError) {
+		t.Fatalf("ldap.v2 Compare = %v, want the strict server to reject its encoding", err)
+	}
+	for i := 0; i < 2; i++ {
+		matched, err := l.Compare(userDN, "memberOf", groupDN)
+		if err != nil || !matched {
+			t.Fatalf("Compare = %v, %v, want true", matched, err)
+		}
+		// ldap.v2 still gets the responses to its own requests.
+		sr, err := l.Search(ldap.NewSearchRequest("dc=example,dc=com", ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+			0, 0, false, "(uid=jdoe)", []string{"uid"}, nil))
+		if err != nil || len(sr.Entries) != 1 {
+			t.Fatalf("Search after Compare = %v, %v, want one entry", sr, err)
+		}
+	}
+	if compares := f.requests("compare"); len(compares) != 3 || compares[2].assertion != [2]string{"memberOf", groupDN} {
+		t.Errorf("server decoded %v, want memberOf=%s", compares, groupDN)
+	}
+}
+
+func TestListGroupTokenGroups(t *testing.T) {
+	const adminsSID, staffSID = "\x01\x05admins", "\x01\x05staff"
+	f := newFakeLDAP(t, true)
+	f.search = func(op fakeOp) []*ldap.Entry {
+		switch {
+		case op.dn == "uid=alice,ou=people,dc=example,dc=com" && op.attributes[0] == "tokenGroups":
+			return []*ldap.Entry{fakeEntry(op.dn, "tokenGroups", adminsSID, "tokenGroups", staffSID)}
+		case op.dn == "uid=bob,ou=people,dc=example,dc=com" && op.attributes[0] == "tokenGroups":
+			return []*ldap.Entry{fakeEntry(op.dn, "tokenGroups", staffSID)}
+		case op.attributes[0] == "objectSid":
+			return []*ldap.Entry{
+				fakeEntry("cn=admins,ou=groups,dc=example,dc=com", "objectSid", adminsSID),
+				fakeEntry("cn=staff,ou=groups,dc=example,dc=com", "objectSid", staffSID),
+			}
+		}
+		return []*ldap.Entry{
+			fakeEntry("uid=alice,ou=people,dc=example,dc=com", "uid", "alice", "uidNumber", "1001", "gidNumber", "1001"),
+			fakeEntry("uid=bob,ou=people,dc=example,dc=com", "uid", "bob", "uidNumber", "1002", "gidNumber", "1002"),
+		}
+	}
+	config := f.config()
+	config.GroupObject = "groups"
+	config.UseTokenGroups = true
+	l, err := connect(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	users, err := listGroup(l, config, "staff", listOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{"alice": {"admins", "staff"}, "bob": {"staff"}}
+	if len(users) != len(want) {
+		t.Fatalf("got %d users, want %d", len(users), len(want))
+	}
+	for _, user := range users {
+		if fmt.Sprint(user.MemberOf) != fmt.Sprint(want[user.Uid]) {
+			t.Errorf("%s is a member of %v, want %v", user.Uid, user.MemberOf, want[user.Uid])
+		}
+	}
+
+	searches := f.requests("search")
+	for _, attribute := range searches[0].attributes {
+		if attribute == "memberOf" {
+			t.Errorf("listing search asked for memberOf: %v", searches[0].attributes)
+		}
+	}
+	resolves := 0
+	for _, search := range searches {
+		if search.attributes[0] == "objectSid" {
+			resolves++
+		}
+	}
+	if resolves != 1 {
+		t.Errorf("%d searches for objectSid, want 1", resolves)
+	}
+	if len(searches) != 4 {
+		t.Errorf("%d searches, want 4: the listing, two tokenGroups reads and one objectSid search", len(searches))
+	}
+}
+
+func TestRecentKeys(t *testing.T) {
+	const pemGarbage = "-----BEGIN PUBLIC KEY-----\nAAAA\n-----END PUBLIC KEY-----"
+	tests := []struct {
+		name   string
+		config AuthkeysConfig
+		values []string
+		stamps []string
+		want   []string
+	}{
+		{
+			name:   "newest first",
+			values: []string{"ssh-ed25519 AAAA1 old", "ssh-ed25519 AAAA2 new", "ssh-ed25519 AAAA3 middle"},
+			stamps: []string{"20200101000000Z", "20240101000000Z", "20220101000000Z"},
+			want:   []string{"ssh-ed25519 AAAA2 new", "ssh-ed25519 AAAA3 middle"},
+		},
+		{
+			name:   "dropped key",
+			config: AuthkeysConfig{PEMKeyPolicy: "skip"},
+			values: []string{"ssh-ed25519 AAAA1 a", pemGarbage, "ssh-ed25519 AAAA3 c", "ssh-ed25519 AAAA4 d"},
+			stamps: []string{"20220101000000Z", "20300101000000Z", "20200101000000Z", "20210101000000Z"},
+			want:   []string{"ssh-ed25519 AAAA1 a", "ssh-ed25519 AAAA4 d"},
+		},
+		{
+			name:   "split value",
+			config: AuthkeysConfig{SplitKeyValuesOnNewline: true},
+			values: []string{"ssh-ed25519 AAAA1 a\nssh-ed25519 AAAA2 b", "ssh-ed25519 AAAA3 c"},
+			stamps: []string{"20200101000000Z", "20240101000000Z"},
+			want:   []string{"ssh-ed25519 AAAA3 c", "ssh-ed25519 AAAA1 a"},
+		},
+		{
+			name:   "missing timestamp",
+			values: []string{"ssh-ed25519 AAAA1 a", "ssh-ed25519 AAAA2 b", "ssh-ed25519 AAAA3 c"},
+			stamps: []string{"20200101000000Z", "20240101000000Z"},
+			want:   []string{"ssh-ed25519 AAAA1 a", "ssh-ed25519 AAAA2 b", "ssh-ed25519 AAAA3 c"},
+		},
+		{
+			name:   "comment dates",
+			values: []string{"ssh-ed25519 AAAA1 jdoe 2021-01-01", "ssh-ed25519 AAAA2 jdoe 2023-01-01", "ssh-ed25519 AAAA3 jdoe 2022-01-01"},
+			want:   []string{"ssh-ed25519 AAAA2 jdoe 2023-01-01", "ssh-ed25519 AAAA3 jdoe 2022-01-01"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := test.config
+			config.MaxRecentKeys = 2
+			var pairs []string
+			if test.stamps != nil {
+				config.KeyTimestampAttribute = "sshPublicKeyCreated"
+				for _, stamp := range test.stamps {
+					pairs = append(pairs, "sshPublicKeyCreated", stamp)
+				}
+			}
+			entry := fakeEntry("uid=jdoe,ou=people,dc=example,dc=com", pairs...)
+			keys, origins := keyLines(config, "jdoe", test.values)
+			got := recentKeys(config, entry, "jdoe", keys, origins, len(test.values))
+			if fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("recentKeys = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestGroupFilter(t *testing.T) {
+	base := AuthkeysConfig{BaseDN: "dc=example,dc=com", GroupObject: "groups", KeyAttribute: "sshPublicKey"}
+	tests := []struct {
+		name   string
+		config func(*AuthkeysConfig)
+		want   string
+	}{
+		{
+			name:   "plain",
+			config: func(c *AuthkeysConfig) {},
+			want:   "(&(objectClass=inetOrgPerson)(memberOf=cn=admins,ou=groups,dc=example,dc=com))",
+		},
+		{
+			name:   "key present",
+			config: func(c *AuthkeysConfig) { c.RequireKeyPresent = true },
+			want:   "(&(objectClass=inetOrgPerson)(memberOf=cn=admins,ou=groups,dc=example,dc=com)(sshPublicKey=*))",
+		},
+		{
+			name: "key present with options and fallbacks",
+			config: func(c *AuthkeysConfig) {
+				c.RequireKeyPresent = true
+				c.KeyAttribute = "sshPublicKey;x-rotation=current"
+				c.KeyAttributeFallbacks = []string{"altSecurityIdentities;range=0-*"}
+			},
+			want: "(&(objectClass=inetOrgPerson)(memberOf=cn=admins,ou=groups,dc=example,dc=com)(|(sshPublicKey=*)(altSecurityIdentities=*)))",
+		},
+		{
+			name: "mapped memberOf and extra",
+			config: func(c *AuthkeysConfig) {
+				c.AttributeMap = map[string]string{"MemberOf": "isMemberOf"}
+				c.GroupFilterExtra = "(!(nsAccountLock=TRUE))"
+			},
+			want: "(&(objectClass=inetOrgPerson)(isMemberOf=cn=admins,ou=groups,dc=example,dc=com)(!(nsAccountLock=TRUE)))",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := base
+			test.config(&config)
+			got := groupFilter(config, "admins")
+			if got != test.want {
+				t.Errorf("groupFilter = %s, want %s", got, test.want)
+			}
+			if _, err := ldap.CompileFilter(got); err != nil {
+				t.Errorf("groupFilter = %s, which doesn't compile: %s", got, err)
+			}
+		})
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	tests := []struct {
+		name     string
+		entries  []*ldap.Entry
+		wantCode int
+	}{
+		{"passes", []*ldap.Entry{fakeEntry("uid=canary,ou=people,dc=example,dc=com", "sshPublicKey", "ssh-ed25519 AAAA canary")}, 0},
+		{"user not found", nil, exitUserNotFound},
+		{"no keys", []*ldap.Entry{fakeEntry("uid=canary,ou=people,dc=example,dc=com")}, exitNoKeys},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFakeLDAP(t, true)
+			f.entries = test.entries
+			config := f.config()
+			config.SelfTestUsername = "canary"
+			config.SelfTestExpectedKeyCount = 1
+			err := selfTest(config)
+			if test.wantCode == 0 {
+				if err != nil {
+					t.Fatalf("selfTest: %s", err)
+				}
+			} else if code := exitCode(err); code != test.wantCode {
+				t.Errorf("selfTest: %v, exit status %d, want %d", err, code, test.wantCode)
+			}
+			waitFor(t, func() bool { return len(f.requests("unbind")) == 1 }, "an unbind")
+		})
+	}
+}
+
+// waitFor waits up to a second for done, which checks on something the fake
+// server has to receive first.
+func waitFor(t *testing.T, done func() bool, what string) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !done(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("fake server never received %s", what)
+		}
+	}
+}
+
+func TestDropLongKeys(t *testing.T) {
+	short := "ssh-ed25519 AAAA jdoe"
+	long := "ssh-rsa " + strings.Repeat("A", 200) + " jdoe"
+	tests := []struct {
+		name    string
+		limit   int
+		options lookupOptions
+		want    []string
+	}{
+		{"under the default limit", 0, lookupOptions{}, []string{short, long}},
+		{"over the limit", 100, lookupOptions{}, []string{short}},
+		{"over the limit, shown", 100, lookupOptions{ShowSuppressed: true},
+			[]string{short, fmt.Sprintf("# suppressed (%d bytes): %s...", len(long), long[:80])}},
+		{"check off", -1, lookupOptions{}, []string{short, long}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := dropLongKeys(AuthkeysConfig{MaxKeyLineBytes: test.limit}, "jdoe", []string{short, long}, test.options)
+			if fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("dropLongKeys = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLookupKeysPrincipals(t *testing.T) {
+	f := newFakeLDAP(t, true)
+	f.entries = []*ldap.Entry{fakeEntry("uid=jdoe,ou=people,dc=example,dc=com",
+		"sshPublicKey", "ssh-ed25519 AAAA jdoe",
+		"sshPrincipal", "jdoe",
+		"sshPrincipal", "deploy")}
+	config := f.config()
+	config.PrincipalAttribute = "sshPrincipal"
+	l, err := connect(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	for _, test := range []struct {
+		options    lookupOptions
+		want       []string
+		attributes []string
+	}{
+		{lookupOptions{}, []string{"ssh-ed25519 AAAA jdoe"}, []string{"sshPublicKey"}},
+		{lookupOptions{Principals: true}, []string{"jdoe", "deploy"}, []string{"sshPrincipal"}},
+	} {
+		got, err := lookupKeys(l, config, "jdoe", test.options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("lookupKeys(%+v) = %q, want %q", test.options, got, test.want)
+		}
+		searches := f.requests("search")
+		if attributes := searches[len(searches)-1].attributes; fmt.Sprint(attributes) != fmt.Sprint(test.attributes) {
+			t.Errorf("lookupKeys(%+v) asked for %v, want %v", test.options, attributes, test.attributes)
+		}
+	}
+}
+
+func TestExpandHomeTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		user     User
+		want     string
+	}{
+		{"/home/{uid}", User{Uid: "jdoe"}, "/home/jdoe"},
+		{"/home/{firstletter}/{uid}", User{Uid: "jdoe"}, "/home/j/jdoe"},
+		{"/home/{firstletter}/{uid}", User{Uid: "élise"}, "/home/é/élise"},
+		{"/srv/{uidNumber}", User{Uid: "jdoe", UidNumber: "1001"}, "/srv/1001"},
+		{"/home/{firstletter}{uid}", User{}, "/home/"},
+	}
+	for _, test := range tests {
+		if got := expandHomeTemplate(test.template, test.user); got != test.want {
+			t.Errorf("expandHomeTemplate(%q, %q) = %q, want %q", test.template, test.user.Uid, got, test.want)
+		}
+	}
+}
+
+func TestMergeConfigDir(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"10-site.json":  `{"BaseDN": "dc=site,dc=example,dc=com", "CanaryUsers": ["site-canary"], "AttributeMap": {"Shell": "ldapShell"}}`,
+		"20-host.json":  `{"BaseDN": "dc=host,dc=example,dc=com", "CanaryUsers": ["host-canary"], "AttributeMap": {"HomeDirectory": "unixHome"}}`,
+		"30-empty.json": `{}`,
+		"README":        `not JSON, and not merged`,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config := AuthkeysConfig{
+		ConfigDir:   dir,
+		BaseDN:      "dc=example,dc=com",
+		LDAPServer:  "ldap.example.com",
+		CanaryUsers: []string{"a", "b"},
+	}
+	if err := mergeConfigDir(&config, true); err != nil {
+		t.Fatal(err)
+	}
+	if config.BaseDN != "dc=host,dc=example,dc=com" {
+		t.Errorf("BaseDN = %q, want the last file's", config.BaseDN)
+	}
+	if config.LDAPServer != "ldap.example.com" {
+		t.Errorf("LDAPServer = %q, want it left alone", config.LDAPServer)
+	}
+	if fmt.Sprint(config.CanaryUsers) != "[host-canary]" {
+		t.Errorf("CanaryUsers = %v, want the last file's list replacing the others", config.CanaryUsers)
+	}
+	if config.AttributeMap["Shell"] != "ldapShell" || config.AttributeMap["HomeDirectory"] != "unixHome" {
+		t.Errorf("AttributeMap = %v, want the keys of both files", config.AttributeMap)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "40-typo.json"), []byte(`{"BaseDNN": "dc=typo"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := mergeConfigDir(&config, true); err == nil || !strings.Contains(err.Error(), "40-typo.json") {
+		t.Errorf("mergeConfigDir with an unknown field = %v, want an error naming the file", err)
+	}
+	if err := mergeConfigDir(&config, false); err != nil {
+		t.Errorf("mergeConfigDir with an unknown field, not strict: %s", err)
+	}
+}
+
+func TestUserFilter(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   AuthkeysConfig
+		username string
+		want     string
+	}{
+		{"plain", AuthkeysConfig{}, "jdoe", "(uid=jdoe)"},
+		{"alias", AuthkeysConfig{AliasAttribute: "uidAlias"}, "jdoe", "(|(uid=jdoe)(uidAlias=jdoe))"},
+		{"alias escaped", AuthkeysConfig{AliasAttribute: "uidAlias"}, "j*do(e)", `(|(uid=j\2ado\28e\29)(uidAlias=j\2ado\28e\29))`},
+		{"alias and extra", AuthkeysConfig{AliasAttribute: "uidAlias", UserFilterExtra: "(objectClass=posixAccount)"}, "jdoe",
+			"(&(|(uid=jdoe)(uidAlias=jdoe))(objectClass=posixAccount))"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := userFilter(test.config, "uid", test.username)
+			if got != test.want {
+				t.Errorf("userFilter = %s, want %s", got, test.want)
+			}
+			if _, err := ldap.CompileFilter(got); err != nil {
+				t.Errorf("userFilter = %s, which doesn't compile: %s", got, err)
+			}
+		})
+	}
+}
+
+func TestLookupKeysFallbacks(t *testing.T) {
+	const dn = "uid=jdoe,ou=people,dc=example,dc=com"
+	tests := []struct {
+		name  string
+		entry *ldap.Entry
+		want  []string
+	}{
+		{"primary present", fakeEntry(dn, "sshPublicKey", "ssh-ed25519 AAAAnew jdoe", "sshPublicKeys", "ssh-rsa AAAAold jdoe"),
+			[]string{"ssh-ed25519 AAAAnew jdoe"}},
+		{"fallback used", fakeEntry(dn, "sshPublicKeys", "ssh-rsa AAAAold jdoe"),
+			[]string{"ssh-rsa AAAAold jdoe"}},
+		{"neither", fakeEntry(dn), nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFakeLDAP(t, true)
+			f.entries = []*ldap.Entry{test.entry}
+			config := f.config()
+			config.KeyAttributeFallbacks = []string{"sshPublicKeys"}
+			l, err := connect(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+
+			got, err := lookupKeys(l, config, "jdoe", lookupOptions{})
+			if test.want == nil {
+				if !errors.Is(err, errNoKeys) {
+					t.Errorf("lookupKeys = %q, %v, want errNoKeys", got, err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("lookupKeys = %q, want %q", got, test.want)
+			}
+			if attributes := f.requests("search")[0].attributes; fmt.Sprint(attributes) != "[sshPublicKey sshPublicKeys]" {
+				t.Errorf("lookupKeys asked for %v, want both key attributes", attributes)
+			}
+		})
+	}
+}
+
+func TestTransports(t *testing.T) {
+	for _, ldaps := range []bool{true, false} {
+		f := newFakeLDAP(t, ldaps)
+		f.entries = []*ldap.Entry{fakeEntry("uid=jdoe,ou=people,dc=example,dc=com", "sshPublicKey", "ssh-ed25519 AAAA jdoe")}
+		config := f.config()
+		l, err := connect(config)
+		if err != nil {
+			t.Fatalf("UseLDAPS %v: %s", ldaps, err)
+		}
+		keys, err := lookupKeys(l, config, "jdoe", lookupOptions{})
+		l.Close()
+		if err != nil || len(keys) != 1 {
+			t.Errorf("UseLDAPS %v: lookupKeys = %q, %v", ldaps, keys, err)
+		}
+		// LDAPS has its one handshake before any LDAP message.
+		want := 1
+		if ldaps {
+			want = 0
+		}
+		if got := len(f.requests("starttls")); got != want {
+			t.Errorf("UseLDAPS %v: %d StartTLS requests, want %d", ldaps, got, want)
+		}
+	}
+}
+
+// BenchmarkConnectToFirstKey measures a short-lived lookup from dialing to
+// having the keys, with each transport: go test -bench ConnectToFirstKey.
+func BenchmarkConnectToFirstKey(b *testing.B) {
+	for _, transport := range []struct {
+		name  string
+		ldaps bool
+	}{{"LDAPS", true}, {"StartTLS", false}} {
+		b.Run(transport.name, func(b *testing.B) {
+			f := newFakeLDAP(b, transport.ldaps)
+			f.entries = []*ldap.Entry{fakeEntry("uid=jdoe,ou=people,dc=example,dc=com", "sshPublicKey", "ssh-ed25519 AAAA jdoe")}
+			config := f.config()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				l, err := connect(config)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := lookupKeys(l, config, "jdoe", lookupOptions{}); err != nil {
+					b.Fatal(err)
+				}
+				l.Close()
+			}
+		})
+	}
+}
+
+func TestListGroupAttributeMap(t *testing.T) {
+	f := newFakeLDAP(t, true)
+	f.entries = []*ldap.Entry{fakeEntry("CN=jdoe,OU=people,DC=example,DC=com",
+		"sAMAccountName", "jdoe",
+		"uidNum", "1001",
+		"gidNum", "100",
+		"isMemberOf", "cn=admins,ou=groups,dc=example,dc=com",
+		"unixHomeDirectory", "/home/jdoe",
+		"ldapShell", "/bin/zsh",
+		// Under the default names, which mustn't be read.
+		"uid", "wrong",
+		"loginShell", "/bin/false")}
+	config := f.config()
+	config.GroupObject = "groups"
+	config.AttributeMap = map[string]string{
+		"Uid":           "sAMAccountName",
+		"UidNumber":     "uidNum",
+		"GidNumber":     "gidNum",
+		"MemberOf":      "isMemberOf",
+		"HomeDirectory": "unixHomeDirectory",
+		"Shell":         "ldapShell",
+	}
+	l, err := connect(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	users, err := listGroup(l, config, "admins", listOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	search := f.requests("search")[0]
+	if want := "[sAMAccountName uidNum gidNum isMemberOf unixHomeDirectory ldapShell]"; fmt.Sprint(search.attributes) != want {
+		t.Errorf("listGroup asked for %v, want %s", search.attributes, want)
+	}
+	if !strings.Contains(search.filter, "(isMemberOf=cn=admins,ou=groups,dc=example,dc=com)") {
+		t.Errorf("listGroup filter %s doesn't use the mapped memberOf", search.filter)
+	}
+	out, err := json.Marshal(users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `[{"id":"jdoe","uid":"1001","gid":"100","groups":["admins"],"home":"/home/jdoe","shell":"/bin/zsh"}]`; string(out) != want {
+		t.Errorf("listGroup = %s, want %s", out, want)
+	}
+}
+
+func TestAttributeValues(t *testing.T) {
+	entry := fakeEntry("uid=jdoe,ou=people,dc=example,dc=com",
+		"sshPublicKey", "untagged",
+		"sshPublicKey;x-rotation=current", "current",
+		"sshPublicKey;x-rotation=archived", "archived",
+		"sshPublicKey;x-rotation=current;x-host=web", "current web",
+		"SSHPUBLICKEY;X-ROTATION=CURRENT", "current shouting")
+	tests := []struct {
+		attribute string
+		want      []string
+	}{
+		{"sshPublicKey", []string{"untagged"}},
+		{"sshPublicKey;x-rotation=current", []string{"current", "current web", "current shouting"}},
+		{"sshPublicKey;x-rotation=archived", []string{"archived"}},
+		{"sshPublicKey;x-host=web;x-rotation=current", []string{"current web"}},
+		{"sshPublicKey;x-rotation=retired", nil},
+		{"sshPublicKeys;x-rotation=current", nil},
+	}
+	for _, test := range tests {
+		if got := attributeValues(entry, test.attribute); fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("attributeValues(%s) = %q, want %q", test.attribute, got, test.want)
+		}
+	}
+}
+
+func TestPrimaryGroupGIDPosix(t *testing.T) {
+	const staffDN = "cn=staff,ou=groups,dc=example,dc=com"
+	const emptyDN = "cn=empty,ou=groups,dc=example,dc=com"
+	f := newFakeLDAP(t, true)
+	f.search = func(op fakeOp) []*ldap.Entry {
+		switch op.dn {
+		case staffDN:
+			return []*ldap.Entry{fakeEntry(staffDN, "gidNumber", "100")}
+		case emptyDN:
+			return []*ldap.Entry{fakeEntry(emptyDN)}
+		}
+		return nil
+	}
+	config := f.config()
+	config.PrimaryGroupAttribute = "gidGroupDN"
+	l, err := connect(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	cache := make(map[string]string)
+	tests := []struct {
+		name    string
+		entry   *ldap.Entry
+		want    string
+		wantErr bool
+	}{
+		{"resolved", fakeEntry("uid=alice,ou=people,dc=example,dc=com", "gidGroupDN", staffDN), "100", false},
+		{"cached", fakeEntry("uid=bob,ou=people,dc=example,dc=com", "gidGroupDN", staffDN), "100", false},
+		{"group without gidNumber", fakeEntry("uid=carol,ou=people,dc=example,dc=com", "gidGroupDN", emptyDN), "", true},
+		{"no primary group", fakeEntry("uid=dave,ou=people,dc=example,dc=com"), "", true},
+	}
+	for _, test := range tests {
+		got, err := primaryGroupGID(l, config, test.entry, cache)
+		if got != test.want || (err != nil) != test.wantErr {
+			t.Errorf("%s: primaryGroupGID = %q, %v, want %q (error %v)", test.name, got, err, test.want, test.wantErr)
+		}
+	}
+	if searches := f.requests("search"); len(searches) != 2 {
+		t.Errorf("%d searches, want one for each group", len(searches))
+	} else if searches[0].dn != staffDN || fmt.Sprint(searches[0].attributes) != "[gidNumber]" {
+		t.Errorf("searched %s for %v, want %s for gidNumber", searches[0].dn, searches[0].attributes, staffDN)
+	}
+}
+
+func TestNewSortControl(t *testing.T) {
+	packet := newSortControl("uid").Encode()
+	if len(packet.Children) != 2 {
+		t.Fatalf("sort control has %d fields, want type and value (not critical)", len(packet.Children))
+	}
+	if oid := packet.Children[0].Value; oid != controlTypeSortRequest {
+		t.Errorf("sort control type %v, want %s", oid, controlTypeSortRequest)
+	}
+	keys, err := ber.DecodePacketErr(packet.Children[1].Data.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys.Children) != 1 || len(keys.Children[0].Children) != 1 || keys.Children[0].Children[0].Value != "uid" {
+		t.Errorf("sort key list %v, want a single key on uid", keys.Children)
+	}
+}
+
+func TestServerSorted(t *testing.T) {
+	response := func(code int64) ldap.Control {
+		value := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Sort Result")
+		value.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "Result"))
+		return ldap.NewControlString(controlTypeSortResponse, false, string(value.Bytes()))
+	}
+	tests := []struct {
+		name     string
+		controls []ldap.Control
+		want     bool
+	}{
+		{"sorted", []ldap.Control{response(ldap.LDAPResultSuccess)}, true},
+		{"unsupported attribute", []ldap.Control{response(ldap.LDAPResultNoSuchAttribute)}, false},
+		{"no response control", nil, false},
+	}
+	for _, test := range tests {
+		if got := serverSorted(&ldap.SearchResult{Controls: test.controls}); got != test.want {
+			t.Errorf("%s: serverSorted = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestListGroupServerSideSort(t *testing.T) {
+	for _, sorted := range []bool{true, false} {
+		f := newFakeLDAP(t, true)
+		// The fake server ignores the control, so sorting falls back to
+		// the client.
+		f.entries = []*ldap.Entry{
+			fakeEntry("uid=carol,ou=people,dc=example,dc=com", "uid", "carol", "uidNumber", "1003", "gidNumber", "100"),
+			fakeEntry("uid=alice,ou=people,dc=example,dc=com", "uid", "alice", "uidNumber", "1001", "gidNumber", "100"),
+			fakeEntry("uid=Bob,ou=people,dc=example,dc=com", "uid", "Bob", "uidNumber", "1002", "gidNumber", "100"),
+		}
+		config := f.config()
+		config.GroupObject = "groups"
+		config.ServerSideSort = sorted
+		l, err := connect(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		users, err := listGroup(l, config, "staff", listOptions{})
+		l.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		controls := f.requests("search")[0].controls
+		if sorted && fmt.Sprint(controls) != "["+controlTypeSortRequest+"]" {
+			t.Errorf("ServerSideSort: search controls %v, want the sort control", controls)
+		} else if !sorted && len(controls) != 0 {
+			t.Errorf("search controls %v, want none", controls)
+		}
+		var uids []string
+		for _, user := range users {
+			uids = append(uids, user.Uid)
+		}
+		want := "[carol alice Bob]"
+		if sorted {
+			want = "[alice Bob carol]"
+		}
+		if fmt.Sprint(uids) != want {
+			t.Errorf("ServerSideSort %v: members %v, want %s", sorted, uids, want)
+		}
+	}
+}
+
+func TestSplitKeyValues(t *testing.T) {
+	blob := "ssh-ed25519 AAAA1 jdoe@laptop\r\n\n  ssh-rsa AAAA2 jdoe@desktop  \nssh-ed25519 AAAA3 jdoe@phone\n"
+	tests := []struct {
+		name   string
+		values []string
+		want   []string
+	}{
+		{"blob", []string{blob}, []string{"ssh-ed25519 AAAA1 jdoe@laptop", "ssh-rsa AAAA2 jdoe@desktop", "ssh-ed25519 AAAA3 jdoe@phone"}},
+		{"blob and single values", []string{"ssh-rsa AAAA0 old", blob}, []string{"ssh-rsa AAAA0 old", "ssh-ed25519 AAAA1 jdoe@laptop", "ssh-rsa AAAA2 jdoe@desktop", "ssh-ed25519 AAAA3 jdoe@phone"}},
+		{"blank", []string{"\n \n"}, nil},
+	}
+	for _, test := range tests {
+		if got := splitKeyValues(test.values); fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%s: splitKeyValues = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+// stalledServer accepts connections and never answers on them, like a
+// server that is up but hung.
+func stalledServer(t *testing.T) LDAPServerConfig {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var conns []net.Conn
+	t.Cleanup(func() {
+		listener.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, c := range conns {
+			c.Close()
+		}
+	})
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, c)
+			mu.Unlock()
+		}
+	}()
+	return LDAPServerConfig{Host: "127.0.0.1", Port: listener.Addr().(*net.TCPAddr).Port}
+}
+
+func TestConnectBudget(t *testing.T) {
+	config := AuthkeysConfig{
+		UseLDAPS:             true,
+		ConnectBudgetSeconds: 1,
+		LDAPServers:          []LDAPServerConfig{stalledServer(t), stalledServer(t), stalledServer(t)},
+	}
+	start := time.Now()
+	_, err := connect(config)
+	elapsed := time.Since(start)
+	if !errors.Is(err, errConnect) {
+		t.Errorf("connect = %v, want a connect error", err)
+	}
+	// Each server alone would be given the 5 second DialTimeout.
+	if elapsed > 1500*time.Millisecond {
+		t.Errorf("connect took %s with a 1 second budget", elapsed)
+	}
+}
+
+// sshKey encodes pub as an authorized_keys line with comment, if any, following
+// RFC 4253, RFC 5656 and RFC 8709 directly rather than through authkeys.
+func sshKey(t *testing.T, pub interface{}, comment string) string {
+	var blob bytes.Buffer
+	writeString := func(b []byte) {
+		var length [4]byte
+		length[0], length[1], length[2], length[3] = byte(len(b)>>24), byte(len(b)>>16), byte(len(b)>>8), byte(len(b))
+		blob.Write(length[:])
+		blob.Write(b)
+	}
+	writeMpint := func(n *big.Int) {
+		b := n.Bytes()
+		if len(b) > 0 && b[0]&0x80 != 0 {
+			b = append([]byte{0}, b...)
+		}
+		writeString(b)
+	}
+	var name string
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		name = "ssh-rsa"
+		writeString([]byte(name))
+		writeMpint(big.NewInt(int64(pub.E)))
+		writeMpint(pub.N)
+	case *ecdsa.PublicKey:
+		curve := map[int]string{256: "nistp256", 384: "nistp384", 521: "nistp521"}[pub.Curve.Params().BitSize]
+		name = "ecdsa-sha2-" + curve
+		point, err := pub.ECDH()
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeString([]byte(name))
+		writeString([]byte(curve))
+		writeString(point.Bytes())
+	case ed25519.PublicKey:
+		name = "ssh-ed25519"
+		writeString([]byte(name))
+		writeString(pub)
+	default:
+		t.Fatalf("no SSH encoding for %T", pub)
+	}
+	key := name + " " + base64.StdEncoding.EncodeToString(blob.Bytes())
+	if comment != "" {
+		key += " " + comment
+	}
+	return key
+}
+
+func ecdsaKey(t *testing.T, curve elliptic.Curve, comment string) string {
+	key, err := ecdsa.GenerateKey(curve, cryptorand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sshKey(t, &key.PublicKey, comment)
+}
+
+func TestDropDisallowedCurves(t *testing.T) {
+	p256 := ecdsaKey(t, elliptic.P256(), "p256")
+	p384 := ecdsaKey(t, elliptic.P384(), "p384")
+	p521 := ecdsaKey(t, elliptic.P521(), "p521")
+	ed := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGSvjasxm0fP2IAhoVfMgHNAWa3pm3FsyN0BE7t6LnAh ed"
+	broken := "ecdsa-sha2-nistp384 AAAAnotbase64 broken"
+	keys := []string{p256, p384, p521, ed, broken}
+	_, brokenErr := ecdsaCurve(broken)
+	if brokenErr == nil {
+		t.Fatalf("ecdsaCurve(%q) didn't fail", broken)
+	}
+	tests := []struct {
+		name    string
+		curves  []string
+		options lookupOptions
+		want    []string
+	}{
+		{"nistp384 and up", []string{"nistp384", "nistp521"}, lookupOptions{}, []string{p384, p521, ed}},
+		{"nistp256 only", []string{"nistp256"}, lookupOptions{}, []string{p256, ed}},
+		{"nistp521 only, shown", []string{"nistp521"}, lookupOptions{ShowSuppressed: true},
+			[]string{suppressedKey("curve nistp256", p256), suppressedKey("curve nistp384", p384), p521, ed,
+				suppressedKey("unreadable curve ("+brokenErr.Error()+")", broken)}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := dropDisallowedCurves(AuthkeysConfig{AllowedECDSACurves: test.curves}, "jdoe", keys, test.options)
+			if fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("dropDisallowedCurves = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCloseUnbinds(t *testing.T) {
+	for _, ldaps := range []bool{true, false} {
+		f := newFakeLDAP(t, ldaps)
+		l, err := connect(f.config())
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Close()
+		waitFor(t, func() bool { return len(f.requests("unbind")) == 1 }, "an unbind")
+	}
+
+	// A connection the server has already dropped still closes.
+	f := newFakeLDAP(t, true)
+	l, err := connect(f.config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.listener.Close()
+	l.netConn.Close()
+	if err := l.unbind(); err == nil {
+		t.Error("unbind on a closed connection succeeded")
+	}
+	l.Close()
+}
+
+func TestConvertPEMKeys(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(cryptorand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, _, err := ed25519.GenerateKey(cryptorand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), cryptorand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkixPEM := func(pub interface{}) string {
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	}
+	pkcs1 := string(pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&rsaKey.PublicKey)}))
+	private := string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("secret")}))
+	openssh := sshKey(t, edPub, "jdoe@laptop")
+
+	tests := []struct {
+		name   string
+		policy string
+		values []string
+		want   []string
+	}{
+		{"RSA", "", []string{pkixPEM(&rsaKey.PublicKey)}, []string{sshKey(t, &rsaKey.PublicKey, "")}},
+		{"RSA PKCS #1", "", []string{pkcs1}, []string{sshKey(t, &rsaKey.PublicKey, "")}},
+		{"ed25519", "", []string{pkixPEM(edPub)}, []string{sshKey(t, edPub, "")}},
+		{"ECDSA", "", []string{pkixPEM(&ecKey.PublicKey)}, []string{sshKey(t, &ecKey.PublicKey, "")}},
+		{"two blocks in one value", "", []string{pkixPEM(edPub) + pkixPEM(&rsaKey.PublicKey)},
+			[]string{sshKey(t, edPub, ""), sshKey(t, &rsaKey.PublicKey, "")}},
+		{"OpenSSH passes through", "", []string{openssh, pkixPEM(edPub)}, []string{openssh, sshKey(t, edPub, "")}},
+		{"private key skipped", "", []string{private, openssh}, []string{openssh}},
+		{"skip policy", "skip", []string{pkixPEM(edPub), openssh}, []string{openssh}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := convertPEMKeys(AuthkeysConfig{PEMKeyPolicy: test.policy}, "jdoe", test.values)
+			if fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("convertPEMKeys = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLookupKeysDomainPrefix(t *testing.T) {
+	tests := []struct {
+		name       string
+		strip      bool
+		separator  string
+		postfix    string
+		username   string
+		wantFilter string
+		wantErr    bool
+	}{
+		{"plain", false, "", "", "jdoe", "(uid=jdoe)", false},
+		{"prefix not stripped", false, "", "", `CORP\jdoe`, "", true},
+		{"prefix stripped", true, "", "", `CORP\jdoe`, "(uid=jdoe)", false},
+		{"no prefix to strip", true, "", "", "jdoe", "(uid=jdoe)", false},
+		{"nested prefixes", true, "", "", `FOREST\CORP\jdoe`, "(uid=jdoe)", false},
+		{"postfix", false, "", "@corp.example", "jdoe", "(uid=jdoe@corp.example)", false},
+		{"prefix stripped and postfix", true, "", "@corp.example", `CORP\jdoe`, "(uid=jdoe@corp.example)", false},
+		{"other separator and postfix", true, "/", "@corp.example", "CORP/jdoe", "(uid=jdoe@corp.example)", false},
+		{"denylisted behind a prefix", true, "", "", `CORP\root`, "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFakeLDAP(t, true)
+			f.entries = []*ldap.Entry{fakeEntry("uid=jdoe,ou=people,dc=example,dc=com", "sshPublicKey", "ssh-ed25519 AAAA jdoe")}
+			config := f.config()
+			config.StripDomainPrefix = test.strip
+			config.DomainPrefixSeparator = test.separator
+			config.UserPostfix = test.postfix
+			config.DenyUsers = []string{"root"}
+			l, err := connect(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+
+			_, err = lookupKeys(l, config, test.username, lookupOptions{})
+			searches := f.requests("search")
+			if test.wantErr {
+				if err == nil || len(searches) != 0 {
+					t.Errorf("lookupKeys(%q) = %v after %d searches, want it refused", test.username, err, len(searches))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(searches) != 1 || searches[0].filter != test.wantFilter {
+				t.Errorf("lookupKeys(%q) searched %v, want %s", test.username, searches, test.wantFilter)
+			}
+		})
+	}
+}
+
+func TestParseScheduleWindow(t *testing.T) {
+	all := [7]bool{true, true, true, true, true, true, true}
+	weekdays := [7]bool{false, true, true, true, true, true, false}
+	tests := []struct {
+		value   string
+		want    scheduleWindow
+		wantErr bool
+	}{
+		{"Mon-Fri 09:00-17:30", scheduleWindow{weekdays, 9 * 60, 17*60 + 30}, false},
+		{"sat,SUN 10:00-14:00", scheduleWindow{[7]bool{true, false, false, false, false, false, true}, 10 * 60, 14 * 60}, false},
+		{"Fri-Mon 22:00-06:00", scheduleWindow{[7]bool{true, true, false, false, false, true, true}, 22 * 60, 6 * 60}, false},
+		{"* 00:00-24:00", scheduleWindow{all, 0, 24 * 60}, false},
+		{"Wed 12:00-12:00", scheduleWindow{}, true},
+		{"Funday 09:00-17:00", scheduleWindow{}, true},
+		{"Mon-Fri 9am-5pm", scheduleWindow{}, true},
+		{"Mon-Fri 24:00-06:00", scheduleWindow{}, true},
+		{"Mon-Fri", scheduleWindow{}, true},
+	}
+	for _, test := range tests {
+		got, err := parseScheduleWindow(test.value)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("parseScheduleWindow(%q) = %+v, want an error", test.value, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("parseScheduleWindow(%q) = %+v, %v, want %+v", test.value, got, err, test.want)
+		}
+	}
+}
+
+func TestScheduleAllows(t *testing.T) {
+	office, _ := parseScheduleWindow("Mon-Fri 09:00-17:00")
+	night, _ := parseScheduleWindow("Fri 22:00-02:00")
+	// 2024-01-01 was a Monday.
+	at := func(day, hour, minute int) time.Time { return time.Date(2024, 1, day, hour, minute, 0, 0, time.UTC) }
+	tests := []struct {
+		name    string
+		windows []scheduleWindow
+		now     time.Time
+		skew    time.Duration
+		allowed bool
+		next    time.Time
+	}{
+		{"inside", []scheduleWindow{office}, at(1, 12, 0), 0, true, time.Time{}},
+		{"before opening", []scheduleWindow{office}, at(1, 8, 0), 0, false, at(1, 9, 0)},
+		{"before opening, within skew", []scheduleWindow{office}, at(1, 8, 58), 5 * time.Minute, true, time.Time{}},
+		{"at closing", []scheduleWindow{office}, at(1, 17, 0), 0, false, at(2, 9, 0)},
+		{"weekend", []scheduleWindow{office}, at(6, 12, 0), 0, false, at(8, 9, 0)},
+		{"past midnight", []scheduleWindow{night}, at(6, 1, 0), 0, true, time.Time{}},
+		{"either window", []scheduleWindow{office, night}, at(5, 23, 0), 0, true, time.Time{}},
+	}
+	for _, test := range tests {
+		allowed, next := scheduleAllows(test.windows, test.now, test.skew)
+		if allowed != test.allowed || !next.Equal(test.next) {
+			t.Errorf("%s: scheduleAllows = %v, %s, want %v, %s", test.name, allowed, next, test.allowed, test.next)
+		}
+	}
+}
+
+func TestDiffKeys(t *testing.T) {
+	edPub, _, err := ed25519.GenerateKey(cryptorand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared := sshKey(t, edPub, "jdoe@laptop")
+	onlyLDAP := ecdsaKey(t, elliptic.P256(), "jdoe@new")
+	onlyFile := ecdsaKey(t, elliptic.P256(), "jdoe@old")
+	keys := []string{"no-pty " + shared, onlyLDAP}
+	file := []string{
+		"# managed by hand",
+		"",
+		sshKey(t, edPub, "a different comment"),
+		"  " + onlyFile + "  ",
+	}
+	diff := diffKeys(keys, file)
+	if fmt.Sprint(diff.OnlyInLDAP) != fmt.Sprint([]string{onlyLDAP}) {
+		t.Errorf("OnlyInLDAP = %q, want %q", diff.OnlyInLDAP, onlyLDAP)
+	}
+	if fmt.Sprint(diff.OnlyInFile) != fmt.Sprint([]string{onlyFile}) {
+		t.Errorf("OnlyInFile = %q, want %q", diff.OnlyInFile, onlyFile)
+	}
+
+	same := diffKeys(keys, keys)
+	out, err := json.Marshal(same)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != `{"only_in_ldap":[],"only_in_file":[]}` {
+		t.Errorf("diffKeys of identical keys = %s, want empty lists", out)
+	}
+}
+
+func TestMatchAssertion(t *testing.T) {
+	config := AuthkeysConfig{MatchingRules: map[string]string{"UID": "caseExactMatch", "mail": "2.5.13.2"}}
+	tests := []struct {
+		attribute string
+		want      string
+	}{
+		{"uid", "(uid:caseExactMatch:=jdoe)"},
+		{"mail", "(mail:2.5.13.2:=jdoe)"},
+		{"cn", "(cn=jdoe)"},
+	}
+	for _, test := range tests {
+		if got := matchAssertion(config, test.attribute, "jdoe"); got != test.want {
+			t.Errorf("matchAssertion(%s) = %s, want %s", test.attribute, got, test.want)
+		}
+	}
+	if got := userFilter(config, "uid", "j(doe"); got != `(uid:caseExactMatch:=j\28doe)` {
+		t.Errorf("userFilter with a matching rule = %s", got)
+	}
+}
+
+func TestValidMatchingRule(t *testing.T) {
+	for rule, want := range map[string]bool{
+		"caseExactMatch":     true,
+		"caseIgnoreIA5Match": true,
+		"x-custom-rule":      true,
+		"2.5.13.5":           true,
+		"":                   false,
+		"2.5.013.5":          false,
+		"2.5..5":             false,
+		"-leadingDash":       false,
+		"case)Exact":         false,
+	} {
+		if got := validMatchingRule(rule); got != want {
+			t.Errorf("validMatchingRule(%q) = %v, want %v", rule, got, want)
+		}
+	}
+}
+
+func TestCheckUsername(t *testing.T) {
+	config := AuthkeysConfig{DenyUsers: []string{"root", "admin"}}
+	tests := []struct {
+		username string
+		wantErr  bool
+	}{
+		{"jdoe", false},
+		{"j.doe-2@example.com", false},
+		{"élise", false},
+		{"root", true},
+		{"Root", false},
+		{"*", true},
+		{"jdoe)(uid=*", true},
+		{`jdoe\2a`, true},
+		{"jdoe\x00", true},
+		{"jdoe\n", true},
+		{"jdoe\x7f", true},
+	}
+	for _, test := range tests {
+		if err := checkUsername(config, test.username); (err != nil) != test.wantErr {
+			t.Errorf("checkUsername(%q) = %v, want error %v", test.username, err, test.wantErr)
+		}
+	}
+}
+
+func TestFromOption(t *testing.T) {
+	config := AuthkeysConfig{FromCIDRAttribute: "allowedNetworks"}
+	tests := []struct {
+		name    string
+		values  []string
+		want    string
+		wantErr bool
+	}{
+		{"none", nil, "", false},
+		{"one", []string{"10.0.0.0/8"}, `from="10.0.0.0/8"`, false},
+		{"several", []string{"10.0.0.0/8", " 2001:db8::/32 "}, `from="10.0.0.0/8,2001:db8::/32"`, false},
+		{"invalid skipped", []string{"10.0.0.0/8", "office", "10.0.0.1"}, `from="10.0.0.0/8"`, false},
+		{"all invalid", []string{"office", `10.0.0.0/8" command="sh`}, "", true},
+	}
+	for _, test := range tests {
+		var pairs []string
+		for _, value := range test.values {
+			pairs = append(pairs, "allowedNetworks", value)
+		}
+		got, err := fromOption(config, fakeEntry("uid=jdoe,ou=people,dc=example,dc=com", pairs...), "jdoe")
+		if got != test.want || (err != nil) != test.wantErr {
+			t.Errorf("%s: fromOption = %s, %v, want %s (error %v)", test.name, got, err, test.want, test.wantErr)
+		}
+	}
+}
+
+func TestValidateFilters(t *testing.T) {
+	base := AuthkeysConfig{BaseDN: "dc=example,dc=com", UserAttribute: "uid", KeyAttribute: "sshPublicKey"}
+	tests := []struct {
+		name    string
+		config  func(*AuthkeysConfig)
+		wantErr string
+	}{
+		{"default", func(c *AuthkeysConfig) {}, ""},
+		{"alias", func(c *AuthkeysConfig) { c.AliasAttribute = "uidAlias" }, ""},
+		{"broken extra", func(c *AuthkeysConfig) { c.UserFilterExtra = "(objectClass=posixAccount" }, "User search filter"},
+		{"parenthesis in the alias", func(c *AuthkeysConfig) { c.AliasAttribute = "uid)(x" }, `AliasAttribute "uid)(x"`},
+		{"broken candidate", func(c *AuthkeysConfig) { c.UserAttributeCandidates = []string{"uid", "mail)"} }, `UserAttribute or UserAttributeCandidates "mail)"`},
+		{"group filter unchecked without GroupObject", func(c *AuthkeysConfig) { c.BaseDN = "dc=example)" }, ""},
+		{"broken group filter", func(c *AuthkeysConfig) {
+			c.GroupObject = "groups"
+			c.BaseDN = "dc=example)"
+		}, `BaseDN "dc=example)"`},
+		{"broken group extra", func(c *AuthkeysConfig) {
+			c.GroupObject = "groups"
+			c.GroupFilterExtra = "(!(nsAccountLock=TRUE)"
+		}, "Group search filter"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := base
+			test.config(&config)
+			err := validateFilters(config)
+			if test.wantErr == "" {
+				if err != nil {
+					t.Errorf("validateFilters: %s", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("validateFilters = %v, want an error mentioning %s", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestListGroupMinimalMissingUid(t *testing.T) {
+	const aliceDN, bobDN = "uid=alice,ou=people,dc=example,dc=com", "uid=bob,ou=people,dc=example,dc=com"
+	f := newFakeLDAP(t, true)
+	f.search = func(op fakeOp) []*ldap.Entry {
+		switch op.dn {
+		case aliceDN:
+			return []*ldap.Entry{fakeEntry(aliceDN, "memberOf", "cn=admins,ou=groups,dc=example,dc=com")}
+		case bobDN:
+			return []*ldap.Entry{fakeEntry(bobDN, "memberOf", "cn=staff,ou=groups,dc=example,dc=com")}
+		}
+		return []*ldap.Entry{
+			fakeEntry(aliceDN, "uidNumber", "1001", "gidNumber", "1001"),
+			fakeEntry(bobDN, "uid", "bob", "uidNumber", "1002", "gidNumber", "1002"),
+		}
+	}
+	config := f.config()
+	config.GroupObject = "groups"
+	config.MissingUidPolicy = "dn"
+	l, err := connect(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	users, err := listGroup(l, config, "staff", listOptions{Minimal: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{"alice": {"admins"}, "bob": {"staff"}}
+	if len(users) != len(want) {
+		t.Fatalf("got %d users, want %d", len(users), len(want))
+	}
+	for _, user := range users {
+		if fmt.Sprint(user.MemberOf) != fmt.Sprint(want[user.Uid]) {
+			t.Errorf("%s is a member of %v, want %v", user.Uid, user.MemberOf, want[user.Uid])
+		}
+	}
+	for _, search := range f.requests("search")[1:] {
+		if search.filter != "(objectClass=*)" {
+			t.Errorf("memberOf read of %s used filter %s, want (objectClass=*)", search.dn, search.filter)
+		}
+	}
+}
+
+func TestApplyKeyOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		values  []string
+		options []string
+		want    []string
+	}{
+		{"one key per value", []string{"ssh-ed25519 AAAA1 a", "ssh-ed25519 AAAA2 b"}, []string{"no-pty", `from="10.0.0.0/8"`},
+			[]string{"no-pty ssh-ed25519 AAAA1 a", `from="10.0.0.0/8" ssh-ed25519 AAAA2 b`}},
+		{"multi-key blob then a single key", []string{"ssh-ed25519 AAAA1 a\nssh-ed25519 AAAA2 b", "ssh-ed25519 AAAA3 c"},
+			[]string{"no-pty", `from="10.0.0.0/8"`},
+			[]string{"no-pty ssh-ed25519 AAAA1 a", "no-pty ssh-ed25519 AAAA2 b", `from="10.0.0.0/8" ssh-ed25519 AAAA3 c`}},
+		{"empty and missing options", []string{"ssh-ed25519 AAAA1 a", "ssh-ed25519 AAAA2 b\nssh-ed25519 AAAA3 c"}, []string{" "},
+			[]string{"ssh-ed25519 AAAA1 a", "ssh-ed25519 AAAA2 b", "ssh-ed25519 AAAA3 c"}},
+		{"surplus options", []string{"ssh-ed25519 AAAA1 a\nssh-ed25519 AAAA2 b"}, []string{"no-pty", "no-X11-forwarding"},
+			[]string{"no-pty ssh-ed25519 AAAA1 a", "no-pty ssh-ed25519 AAAA2 b"}},
+	}
+	config := AuthkeysConfig{SplitKeyValuesOnNewline: true}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keys, origins := keyLines(config, "jdoe", test.values)
+			got := applyKeyOptions(keys, origins, len(test.values), test.options)
+			if fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("applyKeyOptions = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestConnectFailover(t *testing.T) {
+	tests := []struct {
+		name       string
+		setup      func(first, second *fakeLDAP) LDAPServerConfig
+		wantSecond bool
+	}{
+		{"unreachable", func(first, second *fakeLDAP) LDAPServerConfig {
+			first.listener.Close()
+			return first.server()
+		}, true},
+		{"certificate that fails verification", func(first, second *fakeLDAP) LDAPServerConfig {
+			server := first.server()
+			server.RootCAFile = second.caFile
+			return server
+		}, true},
+		{"rejected credentials", func(first, second *fakeLDAP) LDAPServerConfig {
+			first.rejectBind = true
+			return first.server()
+		}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			first, second := newFakeLDAP(t, true), newFakeLDAP(t, true)
+			config := first.config()
+			config.BindDN, config.BindPW = "cn=authkeys,dc=example,dc=com", "secret"
+			config.LDAPServers = []LDAPServerConfig{test.setup(first, second), second.server()}
+			config.LDAPServers[1].Priority = 1
+			l, err := connect(config)
+			if test.wantSecond {
+				if err != nil {
+					t.Fatalf("connect: %s", err)
+				}
+				l.Close()
+			} else if !errors.Is(err, errBind) {
+				t.Fatalf("connect = %v, want the bind error", err)
+			}
+			if binds := len(second.requests("bind")); test.wantSecond != (binds == 1) {
+				t.Errorf("%d binds to the second server, want it tried: %v", binds, test.wantSecond)
+			}
+		})
+	}
+}
+
+func TestCertExpiryFailover(t *testing.T) {
+	tests := []struct {
+		name          string
+		first, second time.Duration
+		wantSecond    bool
+	}{
+		{"first expiring", 24 * time.Hour, 30 * 24 * time.Hour, true},
+		{"both expiring", 24 * time.Hour, 24 * time.Hour, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			first, second := newFakeLDAP(t, true), newFakeLDAP(t, true)
+			first.expireIn(t, test.first)
+			second.expireIn(t, test.second)
+			config := first.config()
+			config.BindDN, config.BindPW = "cn=authkeys,dc=example,dc=com", "secret"
+			config.CertExpiryFailDays = 7
+			config.LDAPServers = []LDAPServerConfig{first.server(), second.server()}
+			config.LDAPServers[1].Priority = 1
+			l, err := connect(config)
+			if test.wantSecond {
+				if err != nil {
+					t.Fatalf("connect: %s", err)
+				}
+				l.Close()
+				if len(first.requests("bind")) != 0 || len(second.requests("bind")) != 1 {
+					t.Errorf("want only the second server bound to")
+				}
+			} else if code := exitCode(err); code != exitConnect {
+				t.Errorf("connect = %v, exit status %d, want %d", err, code, exitConnect)
+			}
+		})
+	}
+}
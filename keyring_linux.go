@@ -0,0 +1,56 @@
+// authkeys - lookup a user's SSH keys as stored in LDAP
+// keyring_linux.go: reading secrets from the kernel keyring.
+//
+// Licensed under the BSD 3-clause license; see LICENSE for more information.
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+// keyctl(2) operations, from linux/keyctl.h.
+const (
+	keyctlRead = 11
+)
+
+// readKeyring returns the payload of the "user" key named description,
+// searching the thread, process and session keyrings of this process.
+func readKeyring(description string) (string, error) {
+	keyType, err := syscall.BytePtrFromString("user")
+	if err != nil {
+		return "", err
+	}
+	name, err := syscall.BytePtrFromString(description)
+	if err != nil {
+		return "", err
+	}
+	// With no callout info, request_key only searches and never asks
+	// /sbin/request-key to construct the key.
+	id, _, errno := syscall.Syscall6(syscall.SYS_REQUEST_KEY,
+		uintptr(unsafe.Pointer(keyType)), uintptr(unsafe.Pointer(name)), 0, 0, 0, 0)
+	if errno != 0 {
+		return "", fmt.Errorf("Unable to find user key %q: %s", description, errno)
+	}
+
+	// Ask for the size first, then read that much.
+	size, _, errno := syscall.Syscall6(syscall.SYS_KEYCTL, keyctlRead, id, 0, 0, 0, 0)
+	if errno != 0 {
+		return "", fmt.Errorf("Unable to read user key %q: %s", description, errno)
+	}
+	if size == 0 {
+		return "", fmt.Errorf("User key %q is empty", description)
+	}
+	payload := make([]byte, size)
+	n, _, errno := syscall.Syscall6(syscall.SYS_KEYCTL, keyctlRead, id,
+		uintptr(unsafe.Pointer(&payload[0])), size, 0, 0)
+	if errno != 0 {
+		return "", fmt.Errorf("Unable to read user key %q: %s", description, errno)
+	}
+	if n < size {
+		payload = payload[:n]
+	}
+	return string(payload), nil
+}
@@ -0,0 +1,16 @@
+// authkeys - lookup a user's SSH keys as stored in LDAP
+// keyring_other.go: stand-in where there is no kernel keyring.
+//
+// Licensed under the BSD 3-clause license; see LICENSE for more information.
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import "fmt"
+
+// readKeyring always fails: only Linux has the kernel keyring.
+func readKeyring(description string) (string, error) {
+	return "", fmt.Errorf("The kernel keyring is only available on Linux")
+}